@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/urfave/cli"
+)
+
+// analyzeCommand lists the inputs a template needs without rendering it.
+func analyzeCommand() cli.Command {
+	return cli.Command{
+		Name:      "analyze",
+		Usage:     "List the variables and functions a template uses",
+		ArgsUsage: "[template]",
+		Flags: []cli.Flag{
+			partialsFlag,
+			cli.StringFlag{
+				Name:  flagFormat,
+				Usage: "The output `FORMAT`, text or json",
+				Value: "text",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			tpl, err := loadTemplateWithPartials(c.Args().First(), c.StringSlice(flagPartials))
+			if err != nil {
+				return exitError(c, err, diagnosticParse)
+			}
+			err = printAnalysis(os.Stdout, analyzeTemplate(tpl), c.String(flagFormat))
+			if err != nil {
+				return exitError(c, err, diagnosticOutput)
+			}
+			return nil
+		},
+	}
+}
+
+// templateAnalysis describes what a template references.
+type templateAnalysis struct {
+	// Fields holds the paths of the variables referenced, such as .db.host.
+	// Elements of a list or map ranged over are written as "[]", as in
+	// .servers[].port.
+	Fields    []string `json:"fields"`
+	Functions []string `json:"functions"`
+	Shell     bool     `json:"shell"`
+
+	// locations holds the template:line:column each field is first
+	// referenced at.
+	locations map[string]string
+	// references holds the paths of the fields each node references.
+	references map[parse.Node][]string
+}
+
+func printAnalysis(out io.Writer, a *templateAnalysis, format string) error {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(a, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", data)
+		return err
+	case "text":
+		fmt.Fprintln(out, "Fields:")
+		for _, f := range a.Fields {
+			fmt.Fprintln(out, "  "+f)
+		}
+		fmt.Fprintln(out, "Functions:")
+		for _, f := range a.Functions {
+			fmt.Fprintln(out, "  "+f)
+		}
+		shell := "no"
+		if a.Shell {
+			shell = "yes"
+		}
+		_, err := fmt.Fprintln(out, "Shell: "+shell)
+		return err
+	}
+	return withKind(diagnosticUsage, fmt.Errorf("Invalid format %q: must be text or json", format))
+}
+
+// analyzeTemplate walks the parse tree of tpl, following the templates it
+// invokes with template and include.
+func analyzeTemplate(tpl *template.Template) *templateAnalysis {
+	a := &analyzer{
+		tpl:        tpl,
+		fields:     make(map[string]bool),
+		funcs:      make(map[string]bool),
+		active:     make(map[string]bool),
+		locations:  make(map[string]string),
+		references: make(map[parse.Node][]string),
+		visited:    make(map[string]bool),
+	}
+	a.template(tpl.Name(), rootPath)
+
+	return &templateAnalysis{
+		Fields:     sortedKeys(a.fields),
+		Functions:  sortedKeys(a.funcs),
+		Shell:      a.funcs["shell"],
+		locations:  a.locations,
+		references: a.references,
+	}
+}
+
+// valuePath is the variable path a value of the template comes from, if it
+// is known.
+type valuePath struct {
+	path  string
+	known bool
+}
+
+var (
+	rootPath    = valuePath{known: true}
+	unknownPath = valuePath{}
+)
+
+// child returns the path of field key below p.
+func (p valuePath) child(key string) valuePath {
+	if !p.known {
+		return p
+	}
+	if strings.ContainsAny(key, ".[]\\\"' ") {
+		key = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(key) + `"`
+	}
+	return valuePath{path: p.path + "." + key, known: true}
+}
+
+// element returns the path of the elements of p.
+func (p valuePath) element() valuePath {
+	if !p.known {
+		return p
+	}
+	return valuePath{path: p.path + "[]", known: true}
+}
+
+// analyzerScope tracks what dot and the variables in scope refer to.
+type analyzerScope struct {
+	dot  valuePath
+	vars map[string]valuePath
+}
+
+func (s analyzerScope) with(dot valuePath) analyzerScope {
+	vars := make(map[string]valuePath, len(s.vars))
+	for k, v := range s.vars {
+		vars[k] = v
+	}
+	return analyzerScope{dot: dot, vars: vars}
+}
+
+type analyzer struct {
+	tpl    *template.Template
+	fields map[string]bool
+	funcs  map[string]bool
+	// locations holds where each field is first referenced.
+	locations  map[string]string
+	references map[parse.Node][]string
+	// tree is the parse tree being walked.
+	tree *parse.Tree
+	// active holds the templates being walked, and visited the templates
+	// walked by name and dot.
+	active  map[string]bool
+	visited map[string]bool
+}
+
+// template walks the template called name, invoked with dot. A template
+// invoking itself, directly or not, is not walked again.
+func (a *analyzer) template(name string, dot valuePath) {
+	key := fmt.Sprintf("%s\x00%v", name, dot)
+	if a.active[name] || a.visited[key] {
+		return
+	}
+	a.visited[key] = true
+
+	t := a.tpl.Lookup(name)
+	if t == nil || t.Tree == nil {
+		return
+	}
+	a.active[name] = true
+	tree := a.tree
+	a.tree = t.Tree
+	a.walk(t.Tree.Root, analyzerScope{dot: dot, vars: map[string]valuePath{"$": dot}})
+	a.tree = tree
+	a.active[name] = false
+}
+
+func (a *analyzer) walk(node parse.Node, s analyzerScope) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			a.walk(child, s)
+		}
+	case *parse.ActionNode:
+		a.pipe(n.Pipe, s, true)
+	case *parse.IfNode:
+		inner := s.with(s.dot)
+		a.pipe(n.Pipe, inner, true)
+		a.walk(n.List, inner)
+		a.walk(n.ElseList, s.with(s.dot))
+	case *parse.WithNode:
+		inner := s.with(s.dot)
+		p := a.pipe(n.Pipe, inner, true)
+		inner.dot = p
+		a.walk(n.List, inner)
+		a.walk(n.ElseList, s.with(s.dot))
+	case *parse.RangeNode:
+		inner := s.with(s.dot)
+		elem := a.pipe(n.Pipe, inner, false).element()
+		switch len(n.Pipe.Decl) {
+		case 1:
+			inner.vars[n.Pipe.Decl[0].Ident[0]] = elem
+		case 2:
+			inner.vars[n.Pipe.Decl[0].Ident[0]] = unknownPath
+			inner.vars[n.Pipe.Decl[1].Ident[0]] = elem
+		}
+		inner.dot = elem
+		a.walk(n.List, inner)
+		a.walk(n.ElseList, s.with(s.dot))
+	case *parse.TemplateNode:
+		dot := unknownPath
+		if n.Pipe != nil {
+			dot = a.pipe(n.Pipe, s, true)
+		}
+		a.template(n.Name, dot)
+	}
+}
+
+// pipe walks a pipeline, returning the path of its value. When assign is
+// set, the variables it declares are assigned that path.
+func (a *analyzer) pipe(p *parse.PipeNode, s analyzerScope, assign bool) valuePath {
+	if p == nil {
+		return unknownPath
+	}
+	result := unknownPath
+	for _, cmd := range p.Cmds {
+		result = a.command(cmd, s)
+	}
+	if len(p.Cmds) != 1 {
+		result = unknownPath
+	}
+	if assign {
+		for _, v := range p.Decl {
+			s.vars[v.Ident[0]] = result
+		}
+	}
+	return result
+}
+
+func (a *analyzer) command(cmd *parse.CommandNode, s analyzerScope) valuePath {
+	if len(cmd.Args) == 0 {
+		return unknownPath
+	}
+	id, ok := cmd.Args[0].(*parse.IdentifierNode)
+	if !ok {
+		p := a.arg(cmd.Args[0], s)
+		for _, arg := range cmd.Args[1:] {
+			a.arg(arg, s)
+		}
+		if len(cmd.Args) > 1 {
+			return unknownPath
+		}
+		return p
+	}
+
+	a.funcs[id.Ident] = true
+	args := make([]valuePath, len(cmd.Args))
+	for i, arg := range cmd.Args[1:] {
+		args[i+1] = a.arg(arg, s)
+	}
+
+	switch id.Ident {
+	case "index":
+		if len(cmd.Args) < 2 {
+			return unknownPath
+		}
+		p := args[1]
+		for _, key := range cmd.Args[2:] {
+			switch k := key.(type) {
+			case *parse.StringNode:
+				p = p.child(k.Text)
+			case *parse.NumberNode:
+				p = p.element()
+			default:
+				return unknownPath
+			}
+		}
+		a.record(p, cmd)
+		return p
+	case "include":
+		if len(cmd.Args) < 2 {
+			return unknownPath
+		}
+		if name, ok := cmd.Args[1].(*parse.StringNode); ok {
+			dot := unknownPath
+			if len(cmd.Args) > 2 {
+				dot = args[2]
+			}
+			a.template(name.Text, dot)
+		}
+	}
+	return unknownPath
+}
+
+// arg walks a command argument, recording the fields it references, and
+// returns its path.
+func (a *analyzer) arg(node parse.Node, s analyzerScope) valuePath {
+	switch n := node.(type) {
+	case *parse.DotNode:
+		a.record(s.dot, n)
+		return s.dot
+	case *parse.FieldNode:
+		return a.field(s.dot, n.Ident, n)
+	case *parse.VariableNode:
+		v, ok := s.vars[n.Ident[0]]
+		if !ok {
+			v = unknownPath
+		}
+		if len(n.Ident) == 1 {
+			return v
+		}
+		return a.field(v, n.Ident[1:], n)
+	case *parse.ChainNode:
+		return a.field(a.arg(n.Node, s), n.Field, n)
+	case *parse.PipeNode:
+		return a.pipe(n, s, true)
+	case *parse.IdentifierNode:
+		a.funcs[n.Ident] = true
+	}
+	return unknownPath
+}
+
+// field records and returns the path of the fields idents below p.
+func (a *analyzer) field(p valuePath, idents []string, node parse.Node) valuePath {
+	for _, ident := range idents {
+		p = p.child(ident)
+	}
+	a.record(p, node)
+	return p
+}
+
+// record records a reference to p by node, unless p is unknown or the root.
+func (a *analyzer) record(p valuePath, node parse.Node) {
+	if !p.known || p.path == "" {
+		return
+	}
+	a.references[node] = append(a.references[node], p.path)
+	if !a.fields[p.path] {
+		a.fields[p.path] = true
+		location, _ := a.tree.ErrorContext(node)
+		a.locations[p.path] = templateLocation(location)
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
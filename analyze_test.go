@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeTemplate(t *testing.T) {
+	tests := []struct {
+		tpl       string
+		fields    []string
+		functions []string
+		shell     bool
+	}{
+		{
+			tpl:       `{{ .name | upper }} {{ $.Env.HOME }}`,
+			fields:    []string{".Env.HOME", ".name"},
+			functions: []string{"upper"},
+		},
+		{
+			tpl:    `{{ range $i, $s := .servers }}{{ $s.name }}{{ .port }}{{ $.global }}{{ end }}`,
+			fields: []string{".global", ".servers", ".servers[].name", ".servers[].port"},
+		},
+		{
+			tpl:    `{{ with .db }}{{ .user }}{{ else }}{{ .nodb }}{{ end }}{{ $x := .a }}{{ $x.b }}`,
+			fields: []string{".a", ".a.b", ".db", ".db.user", ".nodb"},
+		},
+		{
+			tpl:       `{{ index .annotations "kubernetes.io/x" }}{{ (index .list 0).name }}`,
+			fields:    []string{".annotations", `.annotations."kubernetes.io/x"`, ".list", ".list[]", ".list[].name"},
+			functions: []string{"index"},
+		},
+		{
+			tpl:       `{{ define "a" }}{{ .x }}{{ template "b" .y }}{{ end }}{{ define "b" }}{{ .z }}{{ template "a" . }}{{ end }}{{ include "a" .db }}`,
+			fields:    []string{".db", ".db.x", ".db.y", ".db.y.z"},
+			functions: []string{"include"},
+		},
+		{
+			tpl:       `{{ shell "date" }}{{ include .name . }}`,
+			fields:    []string{".name"},
+			functions: []string{"include", "shell"},
+			shell:     true,
+		},
+	}
+	for _, tt := range tests {
+		tpl, err := loadTemplateString("test", tt.tpl)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		a := analyzeTemplate(tpl)
+		if tt.functions == nil {
+			tt.functions = []string{}
+		}
+		if !reflect.DeepEqual(a.Fields, tt.fields) || !reflect.DeepEqual(a.Functions, tt.functions) || a.Shell != tt.shell {
+			t.Errorf("%q broken behavior. Expected: %v %v %v Got: %v %v %v", tt.tpl, tt.fields, tt.functions, tt.shell, a.Fields, a.Functions, a.Shell)
+		}
+	}
+}
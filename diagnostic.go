@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// The kinds of diagnostics, telling what failed.
+const (
+	diagnosticParse = "parse"
+	diagnosticExec  = "exec"
+	diagnosticVars  = "vars"
+	diagnosticShell = "shell"
+	// Errors in the command line options, and writing the output.
+	diagnosticUsage  = "usage"
+	diagnosticOutput = "output"
+)
+
+// diagnostic describes an error in a template or variables file, pointing at
+// where it occurred.
+type diagnostic struct {
+	kind string
+	// template is the name the template was parsed as, and file the path it
+	// was read from, "-" for standard input.
+	template string
+	file     string
+	line     int
+	column   int
+	// key is the variable an error is about, and function the function whose
+	// call failed.
+	key      string
+	function string
+	message  string
+	// format is the format a variables file was parsed as.
+	format string
+	// source is the line of the template the error occurred on.
+	source     string
+	suggestion string
+}
+
+func (d *diagnostic) Error() string {
+	if d.kind == diagnosticVars {
+		if d.format == "" {
+			return fmt.Sprintf("Error parsing variables file %s: %s", d.file, d.message)
+		}
+		return fmt.Sprintf("Error parsing variables file %s as %s: %s", d.file, d.format, d.message)
+	}
+
+	heading := "Error executing template"
+	if d.kind == diagnosticParse {
+		heading = "Error parsing template"
+	}
+	location := d.location()
+	if location == "" {
+		return fmt.Sprintf("%s: %s", heading, d.message)
+	}
+	lines := []string{fmt.Sprintf("%s %s: %s", heading, location, d.message)}
+
+	if d.source != "" {
+		gutter := strconv.Itoa(d.line)
+		lines = append(lines, fmt.Sprintf("  %s | %s", gutter, d.source))
+		if d.column > 0 {
+			lines = append(lines, fmt.Sprintf("  %s | %s^", strings.Repeat(" ", len(gutter)), caretIndent(d.source, d.column)))
+		}
+	}
+	if d.suggestion != "" {
+		lines = append(lines, fmt.Sprintf("Did you mean %s?", d.suggestion))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// location returns the file, line and column of the diagnostic, as far as
+// they are known.
+func (d *diagnostic) location() string {
+	location := d.file
+	if location == "" {
+		location = d.template
+	}
+	if location == "-" {
+		location = "standard input"
+	}
+	if location == "" || d.line == 0 {
+		return location
+	}
+	location += ":" + strconv.Itoa(d.line)
+	if d.column > 0 {
+		location += ":" + strconv.Itoa(d.column)
+	}
+	return location
+}
+
+// caretIndent returns the whitespace placing a caret under column of line,
+// keeping tabs so that it lines up.
+func caretIndent(line string, column int) string {
+	var b strings.Builder
+	for i := 0; i < column-1 && i < len(line); i++ {
+		if line[i] == '\t' {
+			b.WriteByte('\t')
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	return b.String()
+}
+
+// templateLocation converts a template:line:column location reported by
+// text/template, which counts columns from 0, into one counting from 1 as
+// editors do.
+func templateLocation(location string) string {
+	i := strings.LastIndex(location, ":")
+	column, err := strconv.Atoi(location[i+1:])
+	if i < 0 || err != nil {
+		return location
+	}
+	return location[:i+1] + strconv.Itoa(column+1)
+}
+
+// callErrorPattern matches the errors returned by functions.
+var callErrorPattern = regexp.MustCompile(`^error calling (\w+): `)
+
+// execErrorPattern matches the location text/template reports for
+// execution errors. Errors raised within an include repeat it, the last one
+// being where the error occurred.
+var execErrorPattern = regexp.MustCompile(`template: ([^:]+):(\d+):(\d+): executing "[^"]*" at <.*?>: `)
+
+// newExecDiagnostic describes an error executing a template with vars,
+// suggesting the closest existing variable for a missing one.
+func newExecDiagnostic(err error, vars map[string]interface{}) *diagnostic {
+	msg := err.Error()
+	d := &diagnostic{kind: diagnosticExec, message: msg}
+	matches := execErrorPattern.FindAllStringSubmatchIndex(msg, -1)
+	if len(matches) == 0 {
+		return d
+	}
+	m := matches[len(matches)-1]
+	d.template = msg[m[2]:m[3]]
+	d.line, _ = strconv.Atoi(msg[m[4]:m[5]])
+	d.column, _ = strconv.Atoi(msg[m[6]:m[7]])
+	d.column++
+	d.message = msg[m[1]:]
+
+	if c := callErrorPattern.FindStringSubmatch(d.message); c != nil {
+		d.function = c[1]
+		if d.function == "shell" {
+			d.kind = diagnosticShell
+		}
+	}
+	if key, path, ok := parseMissingKeyError(err); ok {
+		d.key = key.key
+		d.message = fmt.Sprintf("missing variable %s", key.key)
+		d.suggestion = closestKey(vars, path)
+	}
+	return d
+}
+
+// newParseDiagnostic describes an error parsing the template in src.
+func newParseDiagnostic(err error, src templateSource) *diagnostic {
+	d := &diagnostic{kind: diagnosticParse, file: src.path, message: err.Error()}
+	if m := parseErrorPattern.FindStringSubmatch(d.message); m != nil {
+		d.line, _ = strconv.Atoi(m[1])
+		d.message = m[3]
+		d.readSource(src)
+	}
+	return d
+}
+
+// varsErrorLinePattern matches the line the YAML, TOML and dotenv parsers
+// report errors at.
+var varsErrorLinePattern = regexp.MustCompile(`\bline (\d+)\b`)
+
+// newVarsDiagnostic describes an error parsing the variables file f.
+func newVarsDiagnostic(err error, f *varsFile) *diagnostic {
+	d := &diagnostic{kind: diagnosticVars, file: f.path, format: f.format, message: err.Error()}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var tomlErr toml.ParseError
+	// The JSON decoder reports the number of bytes read when it failed, the
+	// last of which caused the error.
+	switch {
+	case errors.As(err, &syntaxErr):
+		d.line, d.column = offsetPosition(f.content, syntaxErr.Offset-1)
+	case errors.As(err, &typeErr):
+		d.line, d.column = offsetPosition(f.content, typeErr.Offset-1)
+	case errors.As(err, &tomlErr):
+		d.line, d.column = tomlErr.Position.Line, tomlErr.Position.Col
+	default:
+		if m := varsErrorLinePattern.FindStringSubmatch(d.message); m != nil {
+			d.line, _ = strconv.Atoi(m[1])
+		}
+	}
+	return d
+}
+
+// offsetPosition returns the line and column of the byte at offset in
+// content, both counting from 1.
+func offsetPosition(content []byte, offset int64) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	before := string(content[:offset])
+	line := strings.Count(before, "\n") + 1
+	column := len(before) - strings.LastIndex(before, "\n")
+	return line, column
+}
+
+// setSource sets the file and source line of the diagnostic from the files
+// the template was parsed from.
+func (d *diagnostic) setSource(sources templateSources) {
+	if src, ok := sources[d.template]; ok {
+		d.readSource(src)
+	}
+}
+
+// readSource sets the file and source line of the diagnostic from src.
+func (d *diagnostic) readSource(src templateSource) {
+	if d.line == 0 {
+		return
+	}
+	d.file = src.path
+	text := src.text
+	if text == "" && src.path != "-" {
+		content, err := ioutil.ReadFile(src.path)
+		if err != nil {
+			return
+		}
+		text = string(content)
+	}
+	lines := strings.Split(text, "\n")
+	if d.line <= len(lines) {
+		d.source = strings.TrimRight(lines[d.line-1], "\r")
+	}
+}
+
+// templateSources maps the names templates were parsed as to their files,
+// for diagnostics to show an excerpt of them.
+type templateSources map[string]templateSource
+
+type templateSource struct {
+	path string
+	// text holds the content of templates read from standard input, which
+	// cannot be read again.
+	text string
+}
+
+// closestKey returns the path of the existing variable closest to the missing
+// one at path, by edit distance, or an empty string when none is close. The
+// variables next to the missing one are considered first, then, as the path
+// is relative to dot within range or with, all variables.
+func closestKey(vars map[string]interface{}, path []keyPathSegment) string {
+	missing := path[len(path)-1].key
+	parent := path[:len(path)-1]
+
+	siblings := make(map[string]string)
+	if v, ok := getKeyPath(vars, parent); ok {
+		prefix := ""
+		for _, seg := range parent {
+			prefix += "." + seg.key
+		}
+		if m, ok := toStringMap(v); ok {
+			for k := range m {
+				siblings[prefix+"."+k] = k
+			}
+		}
+	}
+	if key := closestCandidate(missing, siblings); key != "" {
+		return key
+	}
+	all := make(map[string]string)
+	collectKeys(vars, "", all)
+	return closestCandidate(missing, all)
+}
+
+// closestCandidate returns the path in candidates whose key is closest to
+// missing, if it is within half its length.
+func closestCandidate(missing string, candidates map[string]string) string {
+	best, bestDistance := "", len(missing)/2+1
+	paths := make([]string, 0, len(candidates))
+	for p := range candidates {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if d := editDistance(strings.ToLower(missing), strings.ToLower(candidates[p])); d < bestDistance {
+			best, bestDistance = p, d
+		}
+	}
+	return best
+}
+
+// collectKeys adds the path of every map key below v to keys, mapped to the
+// key itself.
+func collectKeys(v interface{}, prefix string, keys map[string]string) {
+	m, ok := toStringMap(v)
+	if !ok {
+		return
+	}
+	for k, item := range m {
+		keys[prefix+"."+k] = k
+		collectKeys(item, prefix+"."+k, keys)
+	}
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// jsonDiagnostic is the form diagnostics are printed in by
+// --error-format json.
+type jsonDiagnostic struct {
+	Kind     string `json:"kind"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Function string `json:"function,omitempty"`
+	Message  string `json:"message"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// kindError tags an error which is not a diagnostic with the kind it is
+// reported as, when that differs from the stage it arises in.
+type kindError struct {
+	kind string
+	err  error
+}
+
+func withKind(kind string, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// printJSONErrors prints err as JSON objects, one per line. Errors which are
+// not diagnostics are printed with only kind and their message.
+func printJSONErrors(out io.Writer, err error, kind string, exitCode int) error {
+	var errs []jsonDiagnostic
+	var d *diagnostic
+	var missing *missingKeysError
+	var tagged *kindError
+	switch {
+	case errors.As(err, &d):
+		file := d.file
+		if file == "" {
+			file = d.template
+		}
+		errs = append(errs, jsonDiagnostic{
+			Kind:     d.kind,
+			File:     file,
+			Line:     d.line,
+			Column:   d.column,
+			Key:      d.key,
+			Function: d.function,
+			Message:  d.message,
+		})
+	case errors.As(err, &missing):
+		for _, k := range missing.keys {
+			errs = append(errs, missingKeyDiagnostic(k, fmt.Sprintf("missing variable %s", k.key)))
+		}
+		if k := missing.stopped; k != nil {
+			errs = append(errs, missingKeyDiagnostic(*k, fmt.Sprintf("missing variable %s could not be traced to the variables, nothing was rendered", k.key)))
+		}
+		if missing.outdated != nil {
+			errs = append(errs, jsonDiagnostic{Kind: diagnosticOutput, Message: missing.outdated.Error()})
+		}
+	case errors.As(err, &tagged):
+		errs = append(errs, jsonDiagnostic{Kind: tagged.kind, Message: err.Error()})
+	default:
+		errs = append(errs, jsonDiagnostic{Kind: kind, Message: err.Error()})
+	}
+
+	encoder := json.NewEncoder(out)
+	for _, e := range errs {
+		e.ExitCode = exitCode
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func missingKeyDiagnostic(k missingKey, message string) jsonDiagnostic {
+	d := jsonDiagnostic{Kind: diagnosticExec, File: k.location, Key: k.key, Message: message}
+	parts := strings.Split(k.location, ":")
+	if n := len(parts); n >= 3 {
+		d.File = strings.Join(parts[:n-2], ":")
+		d.Line, _ = strconv.Atoi(parts[n-2])
+		d.Column, _ = strconv.Atoi(parts[n-1])
+	}
+	return d
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestNewExecDiagnostic(t *testing.T) {
+	vars := map[string]interface{}{
+		"database": map[string]interface{}{"host": "db", "port": 5432},
+		"name":     "app",
+	}
+	tests := []struct {
+		tpl      string
+		expected string
+	}{
+		{
+			tpl:      "{{ .name }}\n  {{ .nmae }}",
+			expected: "Error executing template test:2:6: missing variable .nmae\n  2 |   {{ .nmae }}\n    |      ^\nDid you mean .name?",
+		},
+		{
+			tpl:      "\t{{ .database.hots }}",
+			expected: "Error executing template test:1:14: missing variable .database.hots\n  1 | \t{{ .database.hots }}\n    | \t            ^\nDid you mean .database.host?",
+		},
+		{
+			tpl:      "{{ with .database }}{{ .prot }}{{ end }}",
+			expected: "Error executing template test:1:24: missing variable .prot\n  1 | {{ with .database }}{{ .prot }}{{ end }}\n    |                        ^\nDid you mean .database.port?",
+		},
+		{
+			tpl:      "{{ .unrelated }}",
+			expected: "Error executing template test:1:4: missing variable .unrelated\n  1 | {{ .unrelated }}\n    |    ^",
+		},
+		{
+			tpl:      `{{ define "x" }}{{ .nme }}{{ end }}{{ include "x" . }}`,
+			expected: "Error executing template test:1:20: missing variable .nme\n  1 | {{ define \"x\" }}{{ .nme }}{{ end }}{{ include \"x\" . }}\n    |                    ^\nDid you mean .name?",
+		},
+		{
+			tpl:      `{{ fail "oops" }}`,
+			expected: "Error executing template test:1:4: error calling fail: oops\n  1 | {{ fail \"oops\" }}\n    |    ^",
+		},
+	}
+	for _, tt := range tests {
+		tpl, err := loadTemplateString("test", tt.tpl)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tpl.Option("missingkey=error")
+		err = tpl.Execute(&bytes.Buffer{}, vars)
+		if err == nil {
+			t.Fatalf("%q: expected an error", tt.tpl)
+		}
+		d := newExecDiagnostic(err, vars)
+		d.setSource(templateSources{"test": {path: "-", text: tt.tpl}})
+		d.file = "test"
+		if d.Error() != tt.expected {
+			t.Errorf("%q broken behavior. Expected:\n%s\nGot:\n%s", tt.tpl, tt.expected, d.Error())
+		}
+	}
+}
+
+func TestNewExecDiagnosticUnknownError(t *testing.T) {
+	d := newExecDiagnostic(fmt.Errorf("write error"), nil)
+	if expected := "Error executing template: write error"; d.Error() != expected {
+		t.Errorf("newExecDiagnostic broken behavior. Expected: %q Got: %q", expected, d.Error())
+	}
+}
+
+func TestTemplateLocation(t *testing.T) {
+	tests := map[string]string{
+		"test:1:0":    "test:1:1",
+		"a:b.tpl:3:9": "a:b.tpl:3:10",
+		"test":        "test",
+	}
+	for location, expected := range tests {
+		if actual := templateLocation(location); actual != expected {
+			t.Errorf("templateLocation broken behavior. Expected: %q Got: %q", expected, actual)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "abc", 3},
+		{"name", "name", 0},
+		{"nmae", "name", 2},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if actual := editDistance(tt.a, tt.b); actual != tt.expected {
+			t.Errorf("editDistance(%q, %q) broken behavior. Expected: %d Got: %d", tt.a, tt.b, tt.expected, actual)
+		}
+	}
+}
+
+func TestExecDiagnosticFunction(t *testing.T) {
+	tpl, err := loadTemplateString("test", `{{ shell "exit 3" }}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = tpl.Execute(&bytes.Buffer{}, nil)
+	d := newExecDiagnostic(err, nil)
+	if d.kind != diagnosticShell || d.function != "shell" || d.line != 1 || d.column != 4 {
+		t.Errorf("newExecDiagnostic broken behavior. Expected: shell error at 1:4 Got: %s %s at %d:%d", d.kind, d.function, d.line, d.column)
+	}
+}
+
+func TestNewParseDiagnostic(t *testing.T) {
+	_, err := loadTemplateString("-", "text\n{{ if }}")
+	expected := "Error parsing template standard input:2: missing value for if\n  2 | {{ if }}"
+	if err == nil || err.Error() != expected {
+		t.Errorf("loadTemplateString broken behavior. Expected:\n%s\nGot:\n%v", expected, err)
+	}
+}
+
+func TestNewVarsDiagnostic(t *testing.T) {
+	tests := []struct {
+		format   string
+		content  string
+		line     int
+		column   int
+		expected string
+	}{
+		{"json", "{\"a\": 1,\n \"b\": }", 2, 7, "Error parsing variables file vars as json: invalid character '}' looking for beginning of value"},
+		{"json", "[1]", 1, 1, "Error parsing variables file vars as json: json: cannot unmarshal array into Go value of type map[string]interface {}"},
+		{"yaml", "a: 1\nb: [\n", 2, 0, "Error parsing variables file vars as yaml: yaml: line 2: did not find expected node content"},
+		{"toml", "a = \nb = 1\n", 1, 5, "Error parsing variables file vars as toml: toml: line 1 (last key \"a\"): expected value but found '\\n' instead"},
+		{"env", "A=1\nB=\"x\n", 2, 0, "Error parsing variables file vars as env: dotenv: line 2: unterminated quoted value"},
+	}
+	for _, tt := range tests {
+		f := &varsFile{path: "vars", format: tt.format, content: []byte(tt.content)}
+		_, err := f.parse()
+		d, ok := err.(*diagnostic)
+		if !ok || d.line != tt.line || d.column != tt.column || d.Error() != tt.expected {
+			t.Errorf("%s broken behavior. Expected: %d:%d %s Got: %#v", tt.format, tt.line, tt.column, tt.expected, err)
+		}
+	}
+}
+
+func TestPrintJSONErrors(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{
+			err:      &diagnostic{kind: diagnosticExec, template: "test", file: "t.tpl", line: 2, column: 4, key: ".a", message: "missing variable .a", suggestion: ".b"},
+			expected: `{"kind":"exec","file":"t.tpl","line":2,"column":4,"key":".a","message":"missing variable .a","exit_code":1}` + "\n",
+		},
+		{
+			err: &missingKeysError{keys: []missingKey{{"t.tpl:1:4", ".a"}, {"t.tpl:3:1", ".b"}}},
+			expected: `{"kind":"exec","file":"t.tpl","line":1,"column":4,"key":".a","message":"missing variable .a","exit_code":1}` + "\n" +
+				`{"kind":"exec","file":"t.tpl","line":3,"column":1,"key":".b","message":"missing variable .b","exit_code":1}` + "\n",
+		},
+		{
+			err:      fmt.Errorf("Error writing output file: disk full"),
+			expected: `{"kind":"output","message":"Error writing output file: disk full","exit_code":1}` + "\n",
+		},
+		{
+			err:      withKind(diagnosticUsage, fmt.Errorf("Output path out is not a directory")),
+			expected: `{"kind":"usage","message":"Output path out is not a directory","exit_code":1}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := printJSONErrors(&b, tt.err, diagnosticOutput, 1); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if b.String() != tt.expected {
+			t.Errorf("printJSONErrors broken behavior. Expected: %s Got: %s", tt.expected, b.String())
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// dotenvParser parses the contents of a dotenv (.env) file.
+//
+// Each non-empty line holds a KEY=VALUE pair, optionally prefixed with
+// "export". Lines starting with # are comments. Values may be:
+//
+//   - unquoted: surrounding whitespace and trailing " # comments" are removed
+//   - single quoted: taken literally, may span multiple lines
+//   - double quoted: may span multiple lines and support the \n, \r, \t, \",
+//     \\ and \$ escapes
+//
+// Unquoted and double quoted values expand $NAME, ${NAME}, ${NAME:-default}
+// and ${NAME-default} using keys defined earlier in the file, falling back to
+// the process environment.
+type dotenvParser struct {
+	src  string
+	pos  int
+	line int
+	vars map[string]string
+	// lines records the line each key was last set on.
+	lines map[string]int
+}
+
+func unmarshalDotenvFile(content []byte) (map[string]interface{}, error) {
+	p := newDotenvParser(content)
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]interface{}, len(p.vars))
+	for k, v := range p.vars {
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+// dotenvKeyLines returns the line each key of a dotenv file is set on.
+func dotenvKeyLines(content []byte) map[string]int {
+	p := newDotenvParser(content)
+	p.parse()
+	return p.lines
+}
+
+func newDotenvParser(content []byte) *dotenvParser {
+	return &dotenvParser{
+		src:   string(content),
+		line:  1,
+		vars:  make(map[string]string),
+		lines: make(map[string]int),
+	}
+}
+
+func (p *dotenvParser) parse() error {
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil
+		}
+		switch p.peek() {
+		case '\n', '\r':
+			p.next()
+			continue
+		case '#':
+			p.skipLine()
+			continue
+		}
+
+		line := p.line
+		key, err := p.parseKey()
+		if err != nil {
+			return err
+		}
+		p.skipBlank()
+		if p.eof() || p.peek() != '=' {
+			return p.errorf(p.line, "expected '=' after %q", key)
+		}
+		p.next()
+		p.skipBlank()
+
+		val, err := p.parseValue()
+		if err != nil {
+			return err
+		}
+		p.vars[key] = val
+		p.lines[key] = line
+	}
+}
+
+func (p *dotenvParser) parseKey() (string, error) {
+	key := p.readName()
+	if key == "export" && !p.eof() && isBlank(p.peek()) {
+		p.skipBlank()
+		key = p.readName()
+	}
+	if key == "" {
+		return "", p.errorf(p.line, "expected a variable name")
+	}
+	return key, nil
+}
+
+func (p *dotenvParser) readName() string {
+	start := p.pos
+	for !p.eof() && isDotenvKeyChar(p.peek()) {
+		p.next()
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *dotenvParser) parseValue() (string, error) {
+	line := p.line
+	if p.eof() {
+		return "", nil
+	}
+
+	switch p.peek() {
+	case '\'':
+		raw, err := p.readQuoted('\'')
+		if err != nil {
+			return "", err
+		}
+		return raw, p.endQuotedLine()
+	case '"':
+		raw, err := p.readQuoted('"')
+		if err != nil {
+			return "", err
+		}
+		val, err := p.expand(raw, true, line)
+		if err != nil {
+			return "", err
+		}
+		return val, p.endQuotedLine()
+	}
+
+	start := p.pos
+	for !p.eof() && p.peek() != '\n' {
+		p.next()
+	}
+	raw := p.src[start:p.pos]
+	for i := 1; i < len(raw); i++ {
+		if raw[i] == '#' && isBlank(raw[i-1]) {
+			raw = raw[:i]
+			break
+		}
+	}
+	return p.expand(strings.TrimSpace(raw), false, line)
+}
+
+// readQuoted reads a value enclosed in quote, returning it without the quotes
+// and with escape sequences left in place.
+func (p *dotenvParser) readQuoted(quote byte) (string, error) {
+	line := p.line
+	p.next()
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if c == '\\' && quote == '"' {
+			p.next()
+			if !p.eof() {
+				p.next()
+			}
+			continue
+		}
+		if c == quote {
+			raw := p.src[start:p.pos]
+			p.next()
+			return raw, nil
+		}
+		p.next()
+	}
+	return "", p.errorf(line, "unterminated quoted value")
+}
+
+// endQuotedLine consumes the remainder of the line after a quoted value, which
+// may only contain whitespace and a comment.
+func (p *dotenvParser) endQuotedLine() error {
+	p.skipBlank()
+	if p.eof() {
+		return nil
+	}
+	switch p.peek() {
+	case '\n', '\r', '#':
+		p.skipLine()
+		return nil
+	}
+	return p.errorf(p.line, "unexpected characters after quoted value")
+}
+
+// expand replaces variable references in s and, if escapes is set, processes
+// backslash escape sequences.
+func (p *dotenvParser) expand(s string, escapes bool, line int) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if escapes && c == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\', '$':
+				b.WriteByte(s[i])
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		if c != '$' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+
+		if s[i+1] == '{' {
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", p.errorf(line, "unterminated variable reference in %q", s)
+			}
+			val, err := p.lookupExpr(s[i+2:i+2+end], line)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(val)
+			i += 2 + end
+			continue
+		}
+		if isDotenvNameStart(s[i+1]) {
+			j := i + 1
+			for j < len(s) && isDotenvNameChar(s[j]) {
+				j++
+			}
+			val, _ := p.lookup(s[i+1 : j])
+			b.WriteString(val)
+			i = j - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// lookupExpr resolves the contents of a ${...} reference.
+func (p *dotenvParser) lookupExpr(expr string, line int) (string, error) {
+	n := 0
+	for n < len(expr) && isDotenvNameChar(expr[n]) {
+		n++
+	}
+	name, rest := expr[:n], expr[n:]
+	if name == "" {
+		return "", p.errorf(line, "invalid variable reference ${%s}", expr)
+	}
+
+	val, ok := p.lookup(name)
+	switch {
+	case rest == "":
+		return val, nil
+	case strings.HasPrefix(rest, ":-"):
+		if val != "" {
+			return val, nil
+		}
+		return p.expand(rest[2:], false, line)
+	case strings.HasPrefix(rest, "-"):
+		if ok {
+			return val, nil
+		}
+		return p.expand(rest[1:], false, line)
+	}
+	return "", p.errorf(line, "invalid variable reference ${%s}", expr)
+}
+
+func (p *dotenvParser) lookup(name string) (string, bool) {
+	if val, ok := p.vars[name]; ok {
+		return val, true
+	}
+	return os.LookupEnv(name)
+}
+
+func (p *dotenvParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *dotenvParser) peek() byte {
+	return p.src[p.pos]
+}
+
+func (p *dotenvParser) next() {
+	if p.src[p.pos] == '\n' {
+		p.line++
+	}
+	p.pos++
+}
+
+func (p *dotenvParser) skipBlank() {
+	for !p.eof() && isBlank(p.peek()) {
+		p.next()
+	}
+}
+
+func (p *dotenvParser) skipLine() {
+	for !p.eof() && p.peek() != '\n' {
+		p.next()
+	}
+}
+
+func (p *dotenvParser) errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("dotenv: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+func isDotenvKeyChar(c byte) bool {
+	return isDotenvNameChar(c) || c == '.' || c == '-'
+}
+
+func isDotenvNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDotenvNameChar(c byte) bool {
+	return isDotenvNameStart(c) || (c >= '0' && c <= '9')
+}
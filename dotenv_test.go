@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalDotenvFile(t *testing.T) {
+	os.Setenv("GUCCI_DOTENV_TEST", "from_env")
+	defer os.Unsetenv("GUCCI_DOTENV_TEST")
+
+	tests := []struct {
+		in       string
+		expected map[string]interface{}
+	}{
+		{"A=b", map[string]interface{}{"A": "b"}},
+		{"# comment\n\nA=b\n", map[string]interface{}{"A": "b"}},
+		{"export A=b", map[string]interface{}{"A": "b"}},
+		{"export=b", map[string]interface{}{"export": "b"}},
+		{"A = b  # comment", map[string]interface{}{"A": "b"}},
+		{"A=b#c", map[string]interface{}{"A": "b#c"}},
+		{"A=", map[string]interface{}{"A": ""}},
+		{"A='b $HOME \\n' # comment", map[string]interface{}{"A": "b $HOME \\n"}},
+		{"A=\"b\\n\\\"c\\\" \\$X\"", map[string]interface{}{"A": "b\n\"c\" $X"}},
+		{"A=\"line1\nline2\"\nB=c", map[string]interface{}{"A": "line1\nline2", "B": "c"}},
+		{"A=1\nB=${A}2\nC=\"$A$B\"", map[string]interface{}{"A": "1", "B": "12", "C": "112"}},
+		{"A=${GUCCI_DOTENV_TEST}", map[string]interface{}{"A": "from_env"}},
+		{"A=${GUCCI_DOTENV_MISSING:-def}", map[string]interface{}{"A": "def"}},
+		{"E=\nA=${E:-def}\nB=${E-def}", map[string]interface{}{"E": "", "A": "def", "B": ""}},
+		{"A=1\r\nB=2\r\n", map[string]interface{}{"A": "1", "B": "2"}},
+	}
+	for _, tt := range tests {
+		r, err := unmarshalDotenvFile([]byte(tt.in))
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(r, tt.expected) {
+			t.Errorf("broken behavior for %q. Expected: %v. Got: %v", tt.in, tt.expected, r)
+		}
+	}
+}
+
+func TestUnmarshalDotenvFileErrors(t *testing.T) {
+	tests := []struct {
+		in, err string
+	}{
+		{"A", "dotenv: line 1: expected '=' after \"A\""},
+		{"A=b\n=c", "dotenv: line 2: expected a variable name"},
+		{"A=\"b", "dotenv: line 1: unterminated quoted value"},
+		{"A='b' c", "dotenv: line 1: unexpected characters after quoted value"},
+		{"\nA=${B", "dotenv: line 2: unterminated variable reference in \"${B\""},
+	}
+	for _, tt := range tests {
+		_, err := unmarshalDotenvFile([]byte(tt.in))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("broken behavior for %q. Expected: %v. Got: %v", tt.in, tt.err, err)
+		}
+	}
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"text/template"
 
-	"github.com/imdario/mergo"
-
 	"github.com/urfave/cli"
 )
 
@@ -18,13 +20,59 @@ const (
 	flagSetVar     = "s"
 	flagSetVarLong = flagSetVar + ",set-var"
 
+	flagSetString = "set-string"
+	flagSetTyped  = "set"
+	flagSetJSON   = "set-json"
+
+	flagSetFile       = "set-file"
+	flagSetFileBase64 = "set-file-base64"
+
 	flagVarsFile     = "f"
 	flagVarsFileLong = flagVarsFile + ",vars-file"
 
 	flagSetOpt = "o"
 	flagSetOptLong = flagSetOpt + ",tpl-opt"
+
+	flagOutput     = "O"
+	flagOutputLong = flagOutput + ",output"
+
+	flagOutputMode = "output-mode"
+
+	flagTemplateSuffix = "template-suffix"
+
+	flagPartials     = "p"
+	flagPartialsLong = flagPartials + ",partials"
+
+	flagCheck = "check"
+
+	flagMergeStrategy = "merge-strategy"
+
+	flagPrecedence = "precedence"
+	flagInterleave = "interleave"
+
+	flagVerbose = "verbose"
+
+	flagEnvMode      = "env-mode"
+	flagEnvPrefix    = "env-prefix"
+	flagEnvSeparator = "env-separator"
+
+	flagEnvFiles      = "env-files"
+	flagEnvFilesAllow = "env-files-allow"
+	flagEnvFilesDeny  = "env-files-deny"
+
+	flagFormat  = "format"
+	flagExplain = "explain"
+
+	flagSchema         = "schema"
+	flagSchemaDefaults = "schema-defaults"
+
+	flagErrorFormat = "error-format"
 )
 
+// exitCodeOutdated is returned by --check when rendered files differ from
+// the files on disk.
+const exitCodeOutdated = 2
+
 var (
 	AppVersion = "0.0.0-dev.0" // Injected
 )
@@ -33,127 +81,480 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "gucci"
 	app.Usage = "simple CLI Go lang templating"
-	app.UsageText = app.Name + " [options] [template]"
+	app.UsageText = app.Name + " [options] [template | directory]"
 	app.Version = AppVersion
 
-	app.Flags = []cli.Flag{
-		cli.StringSliceFlag{
-			Name:  flagSetVarLong,
-			Usage: "A `KEY=VALUE` pair variable",
-		},
-		cli.StringSliceFlag{
-			Name:  flagVarsFileLong,
-			Usage: "A json or yaml `FILE` from which to read variables (can be specified multiple times)",
-		},
+	app.Flags = append(variableFlags(), []cli.Flag{
 		cli.StringSliceFlag{
 			Name: flagSetOptLong,
 			Usage: "A template option (`KEY=VALUE`) to be applied",
 			Value: &cli.StringSlice{"missingkey=error"},
 		},
+		cli.StringFlag{
+			Name:  flagOutputLong,
+			Usage: "Write the rendered template to `PATH` instead of standard output",
+		},
+		cli.StringFlag{
+			Name:  flagOutputMode,
+			Usage: "The file `MODE` (octal) used when writing to --output",
+			Value: "0644",
+		},
+		cli.StringFlag{
+			Name:  flagTemplateSuffix,
+			Usage: "When rendering a directory, files ending in `SUFFIX` are rendered with it stripped, others are copied verbatim",
+			Value: ".tpl",
+		},
+		partialsFlag,
+		cli.BoolFlag{
+			Name:  flagCheck,
+			Usage: "Do not write anything, instead compare the rendered output with --output and fail when they differ",
+		},
+		cli.StringFlag{
+			Name:  flagErrorFormat,
+			Usage: "The `FORMAT` errors are printed in, text or json (one object per line)",
+			Value: "text",
+		},
+	}...)
+
+	app.Commands = []cli.Command{
+		varsCommand(),
+		analyzeCommand(),
+		initVarsCommand(),
+		lintCommand(),
+	}
+
+	app.Before = func(c *cli.Context) error {
+		errorFormat := c.String(flagErrorFormat)
+		if errorFormat != "text" && errorFormat != "json" {
+			return cli.NewExitError(fmt.Errorf("Invalid error format %q: must be text or json", errorFormat), 1)
+		}
+		return nil
 	}
 
 	app.Action = func(c *cli.Context) error {
+		exit := func(err error, kind string) error {
+			return exitError(c, err, kind)
+		}
+
 		tplPath := c.Args().First()
+		err := checkStdinUsage(tplPath == "", optionStringSlice(c, flagVarsFile))
+		if err != nil {
+			return exit(err, diagnosticUsage)
+		}
 		vars, err := loadVariables(c)
 		if err != nil {
-			return cli.NewExitError(err, 1)
+			return exit(err, diagnosticVars)
 		}
-		err = run(tplPath, vars, c.StringSlice(flagSetOpt))
+		outMode, err := parseFileMode(c.String(flagOutputMode))
 		if err != nil {
-			return cli.NewExitError(err, 1)
+			return exit(err, diagnosticUsage)
+		}
+		partials, err := findPartials(c.StringSlice(flagPartials))
+		if err != nil {
+			return exit(err, diagnosticParse)
+		}
+		err = run(tplPath, vars, renderOptions{
+			tplOpt:    c.StringSlice(flagSetOpt),
+			outPath:   c.String(flagOutput),
+			outMode:   outMode,
+			tplSuffix: c.String(flagTemplateSuffix),
+			partials:  partials,
+			check:     c.Bool(flagCheck),
+		})
+		if err != nil {
+			return exit(err, diagnosticOutput)
 		}
 		return nil
 	}
 	app.Run(os.Args)
 }
 
-func loadInputVarsFile(c *cli.Context) (map[string]interface{}, error) {
-	vars := make(map[string]interface{})
-
-	varsFiles := c.StringSlice(flagVarsFile)
-	for _, varsFilePath := range varsFiles {
-		if varsFilePath != "" {
-			v, err := loadVarsFile(varsFilePath)
-			if err != nil {
-				return nil, err
-			}
-
-			err = mergo.Merge(&vars, v, mergo.WithOverride)
-			if err != nil {
-				return nil, err
-			}
+// exitError reports err in the format given by --error-format, with kind
+// telling what failed unless err is a diagnostic. It is shared by the root
+// action and the commands.
+func exitError(c *cli.Context, err error, kind string) error {
+	code := 1
+	var outdated *outdatedError
+	if errors.As(err, &outdated) {
+		code = exitCodeOutdated
+	}
+	if c.GlobalString(flagErrorFormat) == "json" {
+		if err := printJSONErrors(os.Stderr, err, kind, code); err != nil {
+			return cli.NewExitError(err, 1)
 		}
+		return cli.NewExitError("", code)
 	}
-
-	return vars, nil
+	return cli.NewExitError(err, code)
 }
 
-func loadInputVarsOptions(c *cli.Context) (map[string]interface{}, error) {
-
-	vars := make(map[string]interface{})
+var partialsFlag = cli.StringSliceFlag{
+	Name:  flagPartialsLong,
+	Usage: "A `DIR_OR_GLOB` of template files whose definitions are made available to include and template (can be specified multiple times)",
+}
 
-	for _, varStr := range c.StringSlice(flagSetVar) {
-		key, val := getKeyVal(varStr)
-		varMap := keyValToMap(key, val)
+// variableFlags returns the flags selecting the variables passed to templates,
+// shared by every command loading variables.
+func variableFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  flagSetVarLong,
+			Usage: "A `KEY=VALUE` pair variable",
+		},
+		cli.StringSliceFlag{
+			Name:  flagSetString,
+			Usage: "A `KEY=VALUE` pair variable, the value is always a string (same as --set-var)",
+		},
+		cli.StringSliceFlag{
+			Name:  flagSetTyped,
+			Usage: "A `KEY=VALUE` pair variable, integers, floats, booleans and null are converted",
+		},
+		cli.StringSliceFlag{
+			Name:  flagSetJSON,
+			Usage: "A `KEY=JSON` pair variable, the value is parsed as JSON",
+		},
+		cli.StringSliceFlag{
+			Name:  flagSetFile,
+			Usage: "A `KEY=FILE` pair variable, the value is the verbatim content of FILE",
+		},
+		cli.StringSliceFlag{
+			Name:  flagSetFileBase64,
+			Usage: "A `KEY=FILE` pair variable, the value is the base64 encoded content of FILE",
+		},
+		cli.StringSliceFlag{
+			Name:  flagVarsFileLong,
+			Usage: "A json, yaml, toml or dotenv `FILE` from which to read variables, - for standard input (can be specified multiple times)",
+		},
+		cli.StringFlag{
+			Name:  flagEnvMode,
+			Usage: "How environment variables are exposed: `MODE` root (top level keys), namespaced (under .Env) or none",
+			Value: envModeRoot,
+		},
+		cli.StringFlag{
+			Name:  flagEnvPrefix,
+			Usage: "Only expose environment variables starting with `PREFIX`, with the prefix stripped",
+		},
+		cli.StringFlag{
+			Name:  flagEnvSeparator,
+			Usage: "Split environment variable names on `SEP` into nested keys, e.g. DB__HOST becomes .DB.HOST with __",
+		},
+		cli.BoolFlag{
+			Name:  flagEnvFiles,
+			Usage: "Set X to the content of the file named by each X_FILE environment variable",
+		},
+		cli.StringSliceFlag{
+			Name:  flagEnvFilesAllow,
+			Usage: "Only resolve the X_FILE environment variable for `NAME` with --env-files (can be specified multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  flagEnvFilesDeny,
+			Usage: "Do not resolve the X_FILE environment variable for `NAME` with --env-files (can be specified multiple times)",
+		},
+		cli.StringFlag{
+			Name:  flagPrecedence,
+			Usage: "The `ORDER` in which variable sources override each other, from lowest to highest precedence",
+			Value: strings.Join(defaultPrecedence, ","),
+		},
+		cli.BoolFlag{
+			Name:  flagInterleave,
+			Usage: "Apply variables files and options in the order they are given on the command line",
+		},
+		cli.BoolFlag{
+			Name:  flagVerbose,
+			Usage: "Print details such as the resolved variable sources to standard error",
+		},
+		cli.StringFlag{
+			Name:  flagMergeStrategy,
+			Usage: "How lists from later variables files are merged: replace, append or merge:FIELD to merge entries with the same FIELD value",
+			Value: defaultMergeStrategy.kind,
+		},
+		cli.StringFlag{
+			Name:  flagSchema,
+			Usage: "Validate the variables against the JSON Schema in `FILE` before rendering",
+		},
+		cli.BoolFlag{
+			Name:  flagSchemaDefaults,
+			Usage: "Set missing variables to their default from --schema",
+		},
+	}
+}
 
-		err := mergo.Merge(&vars, varMap, mergo.WithOverride)
-		if err != nil {
-			return nil, err
+// checkStdinUsage makes sure standard input is read at most once, either for
+// the template or for a single variables file.
+func checkStdinUsage(tplFromStdin bool, varsFiles []string) error {
+	stdinVars := 0
+	for _, arg := range varsFiles {
+		if _, path := splitVarsFileArg(arg); path == "-" {
+			stdinVars++
 		}
 	}
-
-	return vars, nil
+	if stdinVars > 0 && tplFromStdin {
+		return fmt.Errorf("Cannot read both the template and variables from standard input, pass the template as a file")
+	}
+	if stdinVars > 1 {
+		return fmt.Errorf("Variables can only be read from standard input once")
+	}
+	return nil
 }
 
 func loadVariables(c *cli.Context) (map[string]interface{}, error) {
-
-	vars, err := loadInputVarsFile(c)
+	sources, err := loadVariableSources(c)
 	if err != nil {
 		return nil, err
 	}
 
-	envVars := env()
-	err = mergo.Merge(&vars, envVars, mergo.WithOverride)
+	vars, err := applySources(sources)
 	if err != nil {
 		return nil, err
 	}
 
-	optVars, err := loadInputVarsOptions(c)
+	schema := optionString(c, flagSchema)
+	if schema == "" {
+		if optionBool(c, flagSchemaDefaults) {
+			return nil, fmt.Errorf("--%s requires --%s", flagSchemaDefaults, flagSchema)
+		}
+		return vars, nil
+	}
+	err = validateVars(vars, schema, optionBool(c, flagSchemaDefaults))
 	if err != nil {
 		return nil, err
 	}
+	return vars, nil
+}
 
-	err = mergo.Merge(&vars, optVars, mergo.WithOverride)
+// loadVariableSources returns the variable sources selected by the command
+// line, printing them with --verbose.
+func loadVariableSources(c *cli.Context) ([]varSource, error) {
+	sources, err := variableSources(c, os.Args[1:])
 	if err != nil {
 		return nil, err
 	}
 
-	return vars, nil
+	if optionBool(c, flagVerbose) {
+		logger.Println("Variable sources, from lowest to highest precedence:")
+		for _, source := range sources {
+			logger.Println("  " + source.name)
+		}
+	}
+	return sources, nil
 }
 
 func executeTemplate(valuesIn map[string]interface{}, out io.Writer, tpl *template.Template, opt []string) error {
+	opt, report := missingKeyOption(opt)
 	tpl.Option(opt...)
-	err := tpl.Execute(out, valuesIn)
+	var err error
+	if report {
+		err = executeReportingMissingKeys(valuesIn, out, tpl)
+	} else {
+		err = tpl.Execute(out, valuesIn)
+	}
+	var missing *missingKeysError
+	if errors.As(err, &missing) {
+		return err
+	}
 	if err != nil {
-		return fmt.Errorf("Failed to parse standard input: %v", err)
+		return newExecDiagnostic(err, valuesIn)
 	}
 	return nil
 }
 
-func run(tplPath string, vars map[string]interface{}, tplOpt []string) error {
-	tpl, err := loadTemplateFileOrStdin(tplPath)
-	if err != nil {
-		return err
+// renderOptions controls how templates are rendered and where the results
+// are written.
+type renderOptions struct {
+	tplOpt    []string
+	outPath   string
+	outMode   os.FileMode
+	tplSuffix string
+	partials  []string
+	check     bool
+}
+
+// outdatedError reports that --check found rendered files differing from the
+// files on disk.
+type outdatedError struct {
+	count int
+}
+
+func (e *outdatedError) Error() string {
+	return fmt.Sprintf("%d file(s) out of date", e.count)
+}
+
+func run(tplPath string, vars map[string]interface{}, opts renderOptions) error {
+	if opts.check && opts.outPath == "" {
+		return withKind(diagnosticUsage, fmt.Errorf("--check requires an output path (--output) to compare against"))
 	}
 
-	err = executeTemplate(vars, os.Stdout, tpl, tplOpt)
+	var files []*renderedFile
+	var err error
+	if isDir(tplPath) {
+		files, err = renderDir(tplPath, vars, opts)
+	} else {
+		var f *renderedFile
+		f, err = renderFile(tplPath, vars, opts.outPath, opts)
+		files = append(files, f)
+	}
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
 	if err != nil {
 		return err
 	}
 
+	// Missing variables reported by missingkey=report are rendered as zero
+	// values, and reported once every file is rendered or checked. As for any
+	// other failure, nothing is written then.
+	var missing []missingKey
+	for _, f := range files {
+		missing = append(missing, f.missing...)
+	}
+
+	if opts.check {
+		err = checkFiles(files)
+	} else if len(missing) == 0 {
+		// Everything rendered successfully, only now write the results out.
+		for _, f := range files {
+			if err = f.write(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(missing) > 0 {
+		var outdated *outdatedError
+		if err != nil && !errors.As(err, &outdated) {
+			return err
+		}
+		return &missingKeysError{keys: missing, outdated: outdated}
+	}
+	return err
+}
+
+// checkFiles compares the rendered files with their destinations, printing a
+// unified diff for each one that differs.
+func checkFiles(files []*renderedFile) error {
+	outdated := 0
+	for _, f := range files {
+		diff, err := f.diff()
+		if err != nil {
+			return err
+		}
+		if diff != "" {
+			logger.Print(diff)
+			outdated++
+		}
+	}
+	if outdated > 0 {
+		return &outdatedError{count: outdated}
+	}
 	return nil
 }
 
+// renderFile renders the template at tplPath, or standard input when tplPath
+// is empty, destined for outPath.
+func renderFile(tplPath string, vars map[string]interface{}, outPath string, opts renderOptions) (*renderedFile, error) {
+	tpl, src, err := loadTemplateSource(tplPath)
+	if err != nil {
+		return nil, err
+	}
+	err = loadPartials(tpl, opts.partials)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := templateSources{tpl.Name(): src}
+	for _, partial := range opts.partials {
+		if _, ok := sources[filepath.Base(partial)]; !ok {
+			sources[filepath.Base(partial)] = templateSource{path: partial}
+		}
+	}
+
+	f := newRenderedFile(outPath, opts.outMode)
+	err = executeTemplate(vars, f.content, tpl, opts.tplOpt)
+	var missing *missingKeysError
+	if errors.As(err, &missing) {
+		missing.setSources(sources)
+		if missing.stopped == nil {
+			f.missing = missing.keys
+			return f, nil
+		}
+	}
+	var diag *diagnostic
+	if errors.As(err, &diag) {
+		diag.setSource(sources)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// renderDir renders every template below inDir into the output directory,
+// mirroring the directory tree. Files ending in the template suffix are
+// rendered with the suffix stripped, all other files are copied verbatim.
+func renderDir(inDir string, vars map[string]interface{}, opts renderOptions) ([]*renderedFile, error) {
+	if opts.outPath == "" {
+		return nil, withKind(diagnosticUsage, fmt.Errorf("An output directory (--output) is required when rendering the directory %s", inDir))
+	}
+	if !isDir(opts.outPath) {
+		if _, err := os.Stat(opts.outPath); err == nil {
+			return nil, withKind(diagnosticUsage, fmt.Errorf("Output path %s is not a directory", opts.outPath))
+		}
+	}
+
+	var files []*renderedFile
+	err := filepath.WalkDir(inDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(inDir, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(opts.outPath, rel)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if sameFile(path, opts.outPath) {
+				return filepath.SkipDir
+			}
+			files = append(files, &renderedFile{path: dest, mode: 0755})
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if strings.HasSuffix(path, opts.tplSuffix) {
+			f, err := renderFile(path, vars, strings.TrimSuffix(dest, opts.tplSuffix), opts)
+			if err != nil {
+				return err
+			}
+			files = append(files, f)
+			return nil
+		}
+
+		f, err := copyFile(path, dest, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
 func logError(msg string, err error) {
 	logger.Println(msg)
 	logger.Println(err.Error())
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// varsPlaceholder is the value of every variable in a generated vars file.
+const varsPlaceholder = "TODO"
+
+// initVarsCommand generates a skeleton vars file for a template.
+func initVarsCommand() cli.Command {
+	return cli.Command{
+		Name:      "init-vars",
+		Usage:     "Print a skeleton variables file for a template, to be filled in",
+		ArgsUsage: "[template]",
+		Flags: []cli.Flag{
+			partialsFlag,
+			cli.StringFlag{
+				Name:  flagFormat,
+				Usage: "The output `FORMAT`, yaml or json",
+				Value: "yaml",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			tpl, err := loadTemplateWithPartials(c.Args().First(), c.StringSlice(flagPartials))
+			if err != nil {
+				return exitError(c, err, diagnosticParse)
+			}
+			err = printSkeletonVars(os.Stdout, skeletonVars(analyzeTemplate(tpl).Fields), c.String(flagFormat))
+			if err != nil {
+				return exitError(c, err, diagnosticOutput)
+			}
+			return nil
+		},
+	}
+}
+
+func printSkeletonVars(out io.Writer, vars map[string]interface{}, format string) error {
+	var data []byte
+	var err error
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(vars, "", "  ")
+		data = append(data, '\n')
+	case "yaml":
+		data, err = yaml.Marshal(vars)
+	default:
+		return withKind(diagnosticUsage, fmt.Errorf("Invalid format %q: must be yaml or json", format))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+// skeletonVars builds variables holding every field path found by
+// analyzeTemplate. Fields with nested fields become maps, fields whose
+// elements are used become lists with a single element, and all other
+// fields are set to a placeholder.
+func skeletonVars(fields []string) map[string]interface{} {
+	vars := make(map[string]interface{})
+	for _, field := range fields {
+		path, err := parseKeyPath(strings.TrimPrefix(field, "."))
+		if err != nil {
+			continue
+		}
+		addSkeletonPath(vars, path)
+	}
+	return vars
+}
+
+// addSkeletonPath adds path below node and returns the updated node. Maps and
+// lists already along the path are kept, placeholders are replaced.
+func addSkeletonPath(node interface{}, path []keyPathSegment) interface{} {
+	if len(path) == 0 {
+		if node == nil {
+			return varsPlaceholder
+		}
+		return node
+	}
+	seg := path[0]
+
+	if seg.isIndex {
+		list, ok := node.([]interface{})
+		if !ok || len(list) == 0 {
+			list = []interface{}{nil}
+		}
+		list[0] = addSkeletonPath(list[0], path[1:])
+		return list
+	}
+
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		m = make(map[string]interface{})
+	}
+	m[seg.key] = addSkeletonPath(m[seg.key], path[1:])
+	return m
+}
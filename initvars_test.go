@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSkeletonVars(t *testing.T) {
+	fields := []string{
+		".a",
+		".a.b",
+		".annotations",
+		`.annotations."kubernetes.io/x"`,
+		".list",
+		".list[]",
+		".name",
+		".servers",
+		".servers[]",
+		".servers[].host",
+		".servers[].port",
+	}
+	expected := map[string]interface{}{
+		"a":           map[string]interface{}{"b": "TODO"},
+		"annotations": map[string]interface{}{"kubernetes.io/x": "TODO"},
+		"list":        []interface{}{"TODO"},
+		"name":        "TODO",
+		"servers": []interface{}{
+			map[string]interface{}{"host": "TODO", "port": "TODO"},
+		},
+	}
+	if vars := skeletonVars(fields); !reflect.DeepEqual(vars, expected) {
+		t.Errorf("skeletonVars broken behavior. Expected: %v Got: %v", expected, vars)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// appendIndex marks a "[]" key path segment, which appends to a list.
+const appendIndex = -1
+
+// maxListIndex bounds list indices in key paths, so that a typo cannot
+// allocate a huge list.
+const maxListIndex = 65536
+
+// keyPathSegment is a single step of a key path: either a map key or a list
+// index.
+type keyPathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+func (s keyPathSegment) String() string {
+	if !s.isIndex {
+		return s.key
+	}
+	if s.index == appendIndex {
+		return "[]"
+	}
+	return fmt.Sprintf("[%d]", s.index)
+}
+
+// parseKeyPath parses a variable key such as `servers[1].port`.
+//
+// Segments are separated by dots and may be followed by any number of list
+// indices: `[N]` selects the Nth element and `[]` appends a new one. A dot,
+// bracket or backslash that is part of a key is escaped with a backslash, as
+// in `annotations.kubernetes\.io/ingress-class`, or the whole segment is
+// quoted, as in `annotations."kubernetes.io/ingress-class"`.
+func parseKeyPath(key string) ([]keyPathSegment, error) {
+	var path []keyPathSegment
+	i := 0
+	for {
+		if i < len(key) && key[i] == '[' {
+			if len(path) == 0 {
+				return nil, fmt.Errorf("invalid key %q: a key cannot start with a list index", key)
+			}
+		} else {
+			name, n, err := readKeyPathName(key, i)
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, keyPathSegment{key: name})
+			i = n
+		}
+
+		for i < len(key) && key[i] == '[' {
+			end := strings.IndexByte(key[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid key %q: unterminated list index", key)
+			}
+			seg, err := parseKeyPathIndex(key, key[i+1:i+end])
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, seg)
+			i += end + 1
+		}
+
+		if i == len(key) {
+			return path, nil
+		}
+		if key[i] != '.' {
+			return nil, fmt.Errorf("invalid key %q: unexpected %q at position %d", key, key[i], i)
+		}
+		i++
+	}
+}
+
+// readKeyPathName reads a map key starting at i, returning it and the
+// position following it.
+func readKeyPathName(key string, i int) (string, int, error) {
+	var b strings.Builder
+	if i < len(key) && (key[i] == '"' || key[i] == '\'') {
+		quote := key[i]
+		for i++; i < len(key); i++ {
+			switch {
+			case key[i] == '\\' && i+1 < len(key):
+				i++
+				b.WriteByte(key[i])
+			case key[i] == quote:
+				return b.String(), i + 1, nil
+			default:
+				b.WriteByte(key[i])
+			}
+		}
+		return "", 0, fmt.Errorf("invalid key %q: unterminated quoted segment", key)
+	}
+
+	for ; i < len(key) && key[i] != '.' && key[i] != '['; i++ {
+		if key[i] == '\\' && i+1 < len(key) {
+			i++
+		}
+		b.WriteByte(key[i])
+	}
+	if b.Len() == 0 {
+		return "", 0, fmt.Errorf("invalid key %q: empty segment", key)
+	}
+	return b.String(), i, nil
+}
+
+func parseKeyPathIndex(key, index string) (keyPathSegment, error) {
+	if index == "" {
+		return keyPathSegment{index: appendIndex, isIndex: true}, nil
+	}
+	n, err := strconv.Atoi(index)
+	if err != nil || n < 0 {
+		return keyPathSegment{}, fmt.Errorf("invalid key %q: list index %q is not a non-negative integer", key, index)
+	}
+	if n >= maxListIndex {
+		return keyPathSegment{}, fmt.Errorf("invalid key %q: list index %d is too large", key, n)
+	}
+	return keyPathSegment{index: n, isIndex: true}, nil
+}
+
+// setKeyPath sets the value at path below node and returns the updated node.
+// Maps and lists along the way are updated in place where they exist, so
+// values set on a list element keep the other elements, and created where
+// they do not.
+func setKeyPath(node interface{}, path []keyPathSegment, val interface{}) interface{} {
+	if len(path) == 0 {
+		return val
+	}
+	seg := path[0]
+
+	if seg.isIndex {
+		list, _ := node.([]interface{})
+		i := seg.index
+		if i == appendIndex {
+			i = len(list)
+		}
+		for len(list) <= i {
+			list = append(list, nil)
+		}
+		list[i] = setKeyPath(list[i], path[1:], val)
+		return list
+	}
+
+	switch m := node.(type) {
+	case map[string]interface{}:
+		m[seg.key] = setKeyPath(m[seg.key], path[1:], val)
+		return m
+	case map[interface{}]interface{}:
+		m[seg.key] = setKeyPath(m[seg.key], path[1:], val)
+		return m
+	}
+	return map[string]interface{}{
+		seg.key: setKeyPath(nil, path[1:], val),
+	}
+}
+
+// getKeyPath returns the value at path below node, and whether it exists.
+func getKeyPath(node interface{}, path []keyPathSegment) (interface{}, bool) {
+	for _, seg := range path {
+		if seg.isIndex {
+			list, ok := node.([]interface{})
+			if !ok || seg.index < 0 || seg.index >= len(list) {
+				return nil, false
+			}
+			node = list[seg.index]
+			continue
+		}
+
+		m, ok := toStringMap(node)
+		if !ok {
+			return nil, false
+		}
+		node, ok = m[seg.key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
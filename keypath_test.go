@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyPath(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"foo", "foo"},
+		{"foo.bar", "foo|bar"},
+		{"servers[1].port", "servers|[1]|port"},
+		{"servers[].port", "servers|[]|port"},
+		{"matrix[0][2]", "matrix|[0]|[2]"},
+		{`annotations.kubernetes\.io/ingress-class`, "annotations|kubernetes.io/ingress-class"},
+		{`annotations."kubernetes.io/ingress-class"`, "annotations|kubernetes.io/ingress-class"},
+		{`a.'b.c'[0]`, "a|b.c|[0]"},
+		{`a."b\"c"`, `a|b"c`},
+		{`a\[0]`, "a[0]"},
+	}
+	for _, tt := range tests {
+		path, err := parseKeyPath(tt.in)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tt.in, err)
+			continue
+		}
+		var segs []string
+		for _, seg := range path {
+			segs = append(segs, seg.String())
+		}
+		if got := strings.Join(segs, "|"); got != tt.expected {
+			t.Errorf("broken behavior for %q. Expected: %v Got: %v", tt.in, tt.expected, got)
+		}
+	}
+}
+
+func TestParseKeyPathErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"a..b",
+		"a.",
+		"[0]",
+		"a[x]",
+		"a[-1]",
+		"a[1",
+		"a[0]b",
+		`a."b`,
+		"a[100000]",
+	}
+	for _, in := range tests {
+		if _, err := parseKeyPath(in); err == nil {
+			t.Errorf("expected error for %q", in)
+		}
+	}
+}
+
+func TestSetKeyPath(t *testing.T) {
+	tests := []struct {
+		vars     map[string]interface{}
+		key      string
+		expected map[string]interface{}
+	}{
+		{
+			map[string]interface{}{},
+			"a.b",
+			map[string]interface{}{"a": map[string]interface{}{"b": "v"}},
+		},
+		{
+			map[string]interface{}{
+				"servers": []interface{}{
+					map[interface{}]interface{}{"host": "a", "port": 1},
+					map[interface{}]interface{}{"host": "b", "port": 2},
+				},
+			},
+			"servers[1].port",
+			map[string]interface{}{
+				"servers": []interface{}{
+					map[interface{}]interface{}{"host": "a", "port": 1},
+					map[interface{}]interface{}{"host": "b", "port": "v"},
+				},
+			},
+		},
+		{
+			map[string]interface{}{"list": []interface{}{"a"}},
+			"list[]",
+			map[string]interface{}{"list": []interface{}{"a", "v"}},
+		},
+		{
+			map[string]interface{}{},
+			"list[2]",
+			map[string]interface{}{"list": []interface{}{nil, nil, "v"}},
+		},
+		{
+			map[string]interface{}{"a": "scalar"},
+			"a.b",
+			map[string]interface{}{"a": map[string]interface{}{"b": "v"}},
+		},
+	}
+	for _, tt := range tests {
+		path, err := parseKeyPath(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setKeyPath(tt.vars, path, "v")
+		if !reflect.DeepEqual(tt.vars, tt.expected) {
+			t.Errorf("broken behavior for %q. Expected: %v Got: %v", tt.key, tt.expected, tt.vars)
+		}
+	}
+}
+
+func TestGetKeyPath(t *testing.T) {
+	vars := map[string]interface{}{
+		"servers": []interface{}{
+			map[interface{}]interface{}{"host": "a", "port": 1},
+		},
+		"empty": nil,
+	}
+	tests := []struct {
+		key      string
+		expected interface{}
+		exists   bool
+	}{
+		{"servers[0].host", "a", true},
+		{"servers[0].port", 1, true},
+		{"servers[1].port", nil, false},
+		{"servers.host", nil, false},
+		{"empty", nil, true},
+		{"missing", nil, false},
+	}
+	for _, tt := range tests {
+		path, err := parseKeyPath(tt.key)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", tt.key, err)
+		}
+		val, exists := getKeyPath(vars, path)
+		if val != tt.expected || exists != tt.exists {
+			t.Errorf("getKeyPath(%q) broken behavior. Expected: %v, %v Got: %v, %v", tt.key, tt.expected, tt.exists, val, exists)
+		}
+	}
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	lintError   = "error"
+	lintWarning = "warning"
+)
+
+// lintRules describes each kind of lint finding, along with its severity.
+var lintRules = []struct {
+	id          string
+	severity    string
+	description string
+}{
+	{"parse-error", lintError, "The template cannot be parsed"},
+	{"unknown-function", lintError, "A function is not defined"},
+	{"undefined-template", lintError, "An included template is not defined"},
+	{"missing-key", lintWarning, "A variable is not set by the variables files"},
+	{"unbalanced-trim", lintWarning, "A block is closed with different whitespace trimming than it is opened with"},
+	{"deprecated-function", lintWarning, "A function is deprecated"},
+	{"shell", lintWarning, "The shell function runs arbitrary commands"},
+}
+
+// deprecatedFuncs maps deprecated functions to their replacement.
+var deprecatedFuncs = map[string]string{
+	"date_in_zone":     "dateInZone",
+	"date_modify":      "dateModify",
+	"must_date_modify": "mustDateModify",
+	"trimall":          "trimAll",
+}
+
+// builtinFuncs lists the functions predefined by text/template.
+var builtinFuncs = []string{
+	"and", "call", "html", "index", "slice", "js", "len", "not", "or", "print",
+	"printf", "println", "urlquery", "eq", "ge", "gt", "le", "lt", "ne",
+}
+
+// blockKeywords are the actions closed by {{ end }}.
+var blockKeywords = []string{"if", "range", "with", "define", "block"}
+
+// lintCommand reports likely problems in templates without rendering them.
+func lintCommand() cli.Command {
+	return cli.Command{
+		Name:      "lint",
+		Usage:     "Report problems in templates",
+		ArgsUsage: "template...",
+		Flags: []cli.Flag{
+			partialsFlag,
+			cli.StringSliceFlag{
+				Name:  flagVarsFileLong,
+				Usage: "A variables `FILE` holding the keys templates may reference (can be specified multiple times)",
+			},
+			cli.StringFlag{
+				Name:  flagFormat,
+				Usage: "The output `FORMAT`, text, json or sarif",
+				Value: "text",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() == 0 {
+				return exitError(c, fmt.Errorf("At least one template to lint is required"), diagnosticUsage)
+			}
+			partials, err := findPartials(c.StringSlice(flagPartials))
+			if err != nil {
+				return exitError(c, err, diagnosticParse)
+			}
+			findings, err := lintTemplates(c.Args(), partials, c.StringSlice(flagVarsFile))
+			if err != nil {
+				return exitError(c, err, diagnosticParse)
+			}
+			err = printFindings(os.Stdout, findings, c.String(flagFormat))
+			if err != nil {
+				return exitError(c, err, diagnosticOutput)
+			}
+			for _, f := range findings {
+				if f.Severity == lintError {
+					return cli.NewExitError("", 1)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// lintFinding is a single problem found by lint.
+type lintFinding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Message  string `json:"message"`
+}
+
+func (f lintFinding) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s [%s]", f.File, f.Line, f.Column, f.Severity, f.Message, f.Rule)
+}
+
+// lintFile is a parsed template file.
+type lintFile struct {
+	path  string
+	text  string
+	trees map[string]*parse.Tree
+}
+
+// linter collects the findings for a set of templates.
+type linter struct {
+	findings []lintFinding
+	funcs    template.FuncMap
+	// files maps parse names, the base names of the files, to their paths.
+	files map[string]string
+}
+
+// lintTemplates lints each template in paths, with the definitions of the
+// partial files available to them. When varsFiles are given, the variables
+// referenced by the templates are looked up in them.
+func lintTemplates(paths, partials, varsFiles []string) ([]lintFinding, error) {
+	var vars map[string]interface{}
+	if len(varsFiles) > 0 {
+		vars = make(map[string]interface{})
+		for _, arg := range varsFiles {
+			v, err := loadVarsFile(arg)
+			if err != nil {
+				return nil, err
+			}
+			if err := mergeVars(vars, v, defaultMergeStrategy.withDirectives()); err != nil {
+				return nil, fmt.Errorf("Error merging variables file %s: %v", arg, err)
+			}
+		}
+	}
+
+	l := &linter{
+		funcs: getFuncMap(template.New("")),
+		files: make(map[string]string),
+	}
+
+	var definitions []*parse.Tree
+	for _, path := range partials {
+		f, err := l.parseFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			continue
+		}
+		l.lintFile(f)
+		for name, tree := range f.trees {
+			if name != filepath.Base(path) {
+				definitions = append(definitions, tree)
+			}
+		}
+	}
+
+	for _, path := range paths {
+		f, err := l.parseFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			continue
+		}
+		l.lintFile(f)
+
+		tpl := template.New(filepath.Base(path))
+		for _, trees := range [][]*parse.Tree{sortedTrees(f.trees), definitions} {
+			for _, tree := range trees {
+				if tpl.Lookup(tree.Name) == nil {
+					if _, err := tpl.AddParseTree(tree.Name, tree); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		l.checkTemplates(f, tpl)
+		if vars != nil {
+			l.checkVars(tpl, vars)
+		}
+	}
+
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		a, b := l.findings[i], l.findings[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return l.findings, nil
+}
+
+// parseErrorPattern matches the errors of text/template/parse.
+var parseErrorPattern = regexp.MustCompile(`^template: [^:]*:(\d+):(?:(\d+):)? (.*)$`)
+
+// parseFile parses a template file without checking that the functions it
+// calls are defined, which is reported by lintFile instead. A file which
+// cannot be parsed is reported as a finding and nil returned.
+func (l *linter) parseFile(path string) (*lintFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading template: %v", err)
+	}
+	name := filepath.Base(path)
+	l.files[name] = path
+
+	trees := make(map[string]*parse.Tree)
+	t := parse.New(name)
+	t.Mode = parse.SkipFuncCheck
+	_, err = t.Parse(string(content), "", "", trees)
+	if err != nil {
+		finding := lintFinding{Rule: "parse-error", File: path, Message: err.Error()}
+		if m := parseErrorPattern.FindStringSubmatch(err.Error()); m != nil {
+			finding.Line, _ = strconv.Atoi(m[1])
+			finding.Column, _ = strconv.Atoi(m[2])
+			finding.Message = m[3]
+		}
+		l.add(finding)
+		return nil, nil
+	}
+	return &lintFile{path: path, text: string(content), trees: trees}, nil
+}
+
+// lintFile reports the problems found within a single file.
+func (l *linter) lintFile(f *lintFile) {
+	for _, tree := range sortedTrees(f.trees) {
+		walkNodes(tree.Root, func(node parse.Node) {
+			id, ok := node.(*parse.IdentifierNode)
+			if !ok {
+				return
+			}
+			switch {
+			case !l.isFunc(id.Ident):
+				l.addAt(tree, node, "unknown-function", fmt.Sprintf("function %q is not defined", id.Ident))
+			case deprecatedFuncs[id.Ident] != "":
+				l.addAt(tree, node, "deprecated-function", fmt.Sprintf("function %q is deprecated, use %q instead", id.Ident, deprecatedFuncs[id.Ident]))
+			case id.Ident == "shell":
+				l.addAt(tree, node, "shell", "shell runs arbitrary commands")
+			}
+		})
+	}
+	l.checkTrimming(f)
+}
+
+// checkTemplates reports templates invoked by f but not defined in tpl.
+func (l *linter) checkTemplates(f *lintFile, tpl *template.Template) {
+	defined := func(name string) bool {
+		t := tpl.Lookup(name)
+		return t != nil && t.Tree != nil
+	}
+	for _, tree := range sortedTrees(f.trees) {
+		walkNodes(tree.Root, func(node parse.Node) {
+			switch n := node.(type) {
+			case *parse.TemplateNode:
+				if !defined(n.Name) {
+					l.addAt(tree, n, "undefined-template", fmt.Sprintf("template %q is not defined", n.Name))
+				}
+			case *parse.CommandNode:
+				if len(n.Args) < 2 {
+					return
+				}
+				id, ok := n.Args[0].(*parse.IdentifierNode)
+				name, isString := n.Args[1].(*parse.StringNode)
+				if ok && id.Ident == "include" && isString && !defined(name.Text) {
+					l.addAt(tree, n, "undefined-template", fmt.Sprintf("template %q is not defined", name.Text))
+				}
+			}
+		})
+	}
+}
+
+// checkVars reports the variables referenced by tpl which are missing from
+// vars. Variables below a missing one are not reported.
+func (l *linter) checkVars(tpl *template.Template, vars map[string]interface{}) {
+	a := analyzeTemplate(tpl)
+	var missing []string
+	for _, field := range a.Fields {
+		below := false
+		for _, m := range missing {
+			if strings.HasPrefix(field, m+".") || strings.HasPrefix(field, m+"[") {
+				below = true
+			}
+		}
+		path, err := parseKeyPath(strings.TrimPrefix(field, "."))
+		if below || err != nil || hasVarsPath(vars, path) {
+			continue
+		}
+		missing = append(missing, field)
+
+		finding := lintFinding{Rule: "missing-key", Message: fmt.Sprintf("%s is not set by the variables files", field)}
+		l.setLocation(&finding, a.locations[field])
+		l.add(finding)
+	}
+}
+
+// hasVarsPath reports whether path exists in vars. A "[]" segment matches
+// when any element of the list has the rest of the path, or the list is
+// empty.
+func hasVarsPath(vars interface{}, path []keyPathSegment) bool {
+	if len(path) == 0 {
+		return true
+	}
+	seg := path[0]
+	if seg.isIndex {
+		list, ok := vars.([]interface{})
+		if !ok {
+			return false
+		}
+		if len(list) == 0 {
+			return true
+		}
+		for _, item := range list {
+			if hasVarsPath(item, path[1:]) {
+				return true
+			}
+		}
+		return false
+	}
+	m, ok := toStringMap(vars)
+	if !ok {
+		return false
+	}
+	val, ok := m[seg.key]
+	return ok && hasVarsPath(val, path[1:])
+}
+
+// lintAction is an action found by scanning the raw text of a template.
+type lintAction struct {
+	keyword      string
+	trimLeft     bool
+	trimRight    bool
+	line, column int
+}
+
+func (a lintAction) String() string {
+	s := "{{"
+	if a.trimLeft {
+		s += "- "
+	} else {
+		s += " "
+	}
+	s += a.keyword
+	if a.trimRight {
+		s += " -"
+	} else {
+		s += " "
+	}
+	return s + "}}"
+}
+
+// checkTrimming reports blocks whose {{ end }} trims whitespace differently
+// from the action opening them. Trim markers are not kept in the parse tree,
+// so the raw text is scanned.
+func (l *linter) checkTrimming(f *lintFile) {
+	var open []lintAction
+	for _, action := range scanActions(f.text) {
+		switch {
+		case indexOf(blockKeywords, action.keyword) >= 0:
+			open = append(open, action)
+		case action.keyword == "end" && len(open) > 0:
+			start := open[len(open)-1]
+			open = open[:len(open)-1]
+			if start.trimLeft != action.trimLeft || start.trimRight != action.trimRight {
+				l.add(lintFinding{
+					Rule:    "unbalanced-trim",
+					File:    f.path,
+					Line:    action.line,
+					Column:  action.column,
+					Message: fmt.Sprintf("%s trims whitespace differently from %s at line %d", action, start, start.line),
+				})
+			}
+		}
+	}
+}
+
+// scanActions returns the actions of a template, skipping over quoted
+// strings and comments.
+func scanActions(text string) []lintAction {
+	var actions []lintAction
+	i := 0
+	for {
+		start := strings.Index(text[i:], "{{")
+		if start < 0 {
+			return actions
+		}
+		start += i
+		body := start + 2
+		action := lintAction{trimLeft: isTrimMarker(text, body)}
+		if action.trimLeft {
+			body += 2
+		}
+		action.line = strings.Count(text[:start], "\n") + 1
+		action.column = start - strings.LastIndex(text[:start], "\n")
+
+		end := findActionEnd(text, body)
+		if end < 0 {
+			return actions
+		}
+		action.trimRight = end >= 2 && text[end-1] == '-' && isSpace(text[end-2])
+		content := strings.TrimSpace(strings.TrimSuffix(text[body:end], "-"))
+		if fields := strings.Fields(content); len(fields) > 0 {
+			action.keyword = fields[0]
+		}
+		if !strings.HasPrefix(content, "/*") {
+			actions = append(actions, action)
+		}
+		i = end + 2
+	}
+}
+
+// findActionEnd returns the position of the "}}" closing the action whose
+// body starts at i, or -1.
+func findActionEnd(text string, i int) int {
+	for i < len(text) {
+		switch {
+		case strings.HasPrefix(text[i:], "}}"):
+			return i
+		case strings.HasPrefix(text[i:], "/*"):
+			end := strings.Index(text[i+2:], "*/")
+			if end < 0 {
+				return -1
+			}
+			i += end + 4
+		case text[i] == '"' || text[i] == '\'' || text[i] == '`':
+			quote := text[i]
+			for i++; i < len(text) && text[i] != quote; i++ {
+				if text[i] == '\\' && quote != '`' {
+					i++
+				}
+			}
+			i++
+		default:
+			i++
+		}
+	}
+	return -1
+}
+
+func isTrimMarker(text string, i int) bool {
+	return i+1 < len(text) && text[i] == '-' && isSpace(text[i+1])
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func (l *linter) isFunc(name string) bool {
+	_, ok := l.funcs[name]
+	return ok || indexOf(builtinFuncs, name) >= 0
+}
+
+// addAt adds a finding for node of tree.
+func (l *linter) addAt(tree *parse.Tree, node parse.Node, rule, message string) {
+	finding := lintFinding{Rule: rule, Message: message}
+	location, _ := tree.ErrorContext(node)
+	l.setLocation(&finding, templateLocation(location))
+	l.add(finding)
+}
+
+// setLocation sets the file, line and column of a finding from a
+// template:line:column location.
+func (l *linter) setLocation(f *lintFinding, location string) {
+	parts := strings.Split(location, ":")
+	if len(parts) < 3 {
+		return
+	}
+	name := strings.Join(parts[:len(parts)-2], ":")
+	f.File = name
+	if path, ok := l.files[name]; ok {
+		f.File = path
+	}
+	f.Line, _ = strconv.Atoi(parts[len(parts)-2])
+	f.Column, _ = strconv.Atoi(parts[len(parts)-1])
+}
+
+func (l *linter) add(f lintFinding) {
+	for _, rule := range lintRules {
+		if rule.id == f.Rule {
+			f.Severity = rule.severity
+		}
+	}
+	for _, existing := range l.findings {
+		if existing == f {
+			return
+		}
+	}
+	l.findings = append(l.findings, f)
+}
+
+// walkNodes calls fn for node and every node below it.
+func walkNodes(node parse.Node, fn func(parse.Node)) {
+	if node == nil {
+		return
+	}
+	fn(node)
+	switch n := node.(type) {
+	case *parse.ListNode:
+		for _, child := range n.Nodes {
+			walkNodes(child, fn)
+		}
+	case *parse.ActionNode:
+		walkNodes(n.Pipe, fn)
+	case *parse.IfNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.RangeNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.WithNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.TemplateNode:
+		if n.Pipe != nil {
+			walkNodes(n.Pipe, fn)
+		}
+	case *parse.PipeNode:
+		for _, cmd := range n.Cmds {
+			walkNodes(cmd, fn)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkNodes(arg, fn)
+		}
+	case *parse.ChainNode:
+		walkNodes(n.Node, fn)
+	}
+}
+
+func walkBranch(n *parse.BranchNode, fn func(parse.Node)) {
+	walkNodes(n.Pipe, fn)
+	if n.List != nil {
+		walkNodes(n.List, fn)
+	}
+	if n.ElseList != nil {
+		walkNodes(n.ElseList, fn)
+	}
+}
+
+func sortedTrees(trees map[string]*parse.Tree) []*parse.Tree {
+	names := make([]string, 0, len(trees))
+	for name := range trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]*parse.Tree, len(names))
+	for i, name := range names {
+		result[i] = trees[name]
+	}
+	return result
+}
+
+func printFindings(out io.Writer, findings []lintFinding, format string) error {
+	switch format {
+	case "text":
+		for _, f := range findings {
+			fmt.Fprintln(out, f)
+		}
+		return nil
+	case "json":
+		if findings == nil {
+			findings = []lintFinding{}
+		}
+		data, err := json.MarshalIndent(findings, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", data)
+		return err
+	case "sarif":
+		data, err := json.MarshalIndent(sarifLog(findings), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", data)
+		return err
+	}
+	return withKind(diagnosticUsage, fmt.Errorf("Invalid format %q: must be text, json or sarif", format))
+}
+
+// sarifLog converts findings into a SARIF 2.1.0 log, as read by code
+// scanning tools.
+func sarifLog(findings []lintFinding) map[string]interface{} {
+	rules := make([]interface{}, len(lintRules))
+	for i, rule := range lintRules {
+		rules[i] = map[string]interface{}{
+			"id":                   rule.id,
+			"shortDescription":     map[string]interface{}{"text": rule.description},
+			"defaultConfiguration": map[string]interface{}{"level": rule.severity},
+		}
+	}
+
+	results := make([]interface{}, len(findings))
+	for i, f := range findings {
+		location := map[string]interface{}{
+			"artifactLocation": map[string]interface{}{"uri": filepath.ToSlash(f.File)},
+		}
+		// A region must start at a line, so findings without one have none.
+		if f.Line > 0 {
+			region := map[string]interface{}{"startLine": f.Line}
+			if f.Column > 0 {
+				region["startColumn"] = f.Column
+			}
+			location["region"] = region
+		}
+		results[i] = map[string]interface{}{
+			"ruleId":  f.Rule,
+			"level":   f.Severity,
+			"message": map[string]interface{}{"text": f.Message},
+			"locations": []interface{}{
+				map[string]interface{}{"physicalLocation": location},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"version": "2.1.0",
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"runs": []interface{}{
+			map[string]interface{}{
+				"tool": map[string]interface{}{
+					"driver": map[string]interface{}{
+						"name":           "gucci",
+						"informationUri": "https://github.com/noqcks/gucci",
+						"rules":          rules,
+					},
+				},
+				"results": results,
+			},
+		},
+	}
+}
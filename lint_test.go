@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestScanActions(t *testing.T) {
+	text := "{{- if .a }}\n{{ \"}}\" }}{{/* {{ end }} */}}\n  {{ end -}}"
+	expected := []lintAction{
+		{keyword: "if", trimLeft: true, line: 1, column: 1},
+		{keyword: `"}}"`, line: 2, column: 1},
+		{keyword: "end", trimRight: true, line: 3, column: 3},
+	}
+	if actions := scanActions(text); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("scanActions broken behavior. Expected: %v Got: %v", expected, actions)
+	}
+}
+
+func TestLintTemplates(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return path
+	}
+	partial := write("partial.tpl", `{{ define "header" }}{{ date_modify "1h" now }}{{ end }}`)
+	vars := write("vars.yaml", "a: 1\nservers:\n  - port: 80\n")
+	tpl := write("test.tpl", `{{- if .a }}{{ .a | frobnicate }}
+{{ end }}{{ include "header" . }}{{ template "missing" }}
+{{ range .servers }}{{ .port }}{{ .host }}{{ end }}{{ .db.host }}{{ .db.port }}
+{{ shell "date" }}`)
+
+	findings, err := lintTemplates([]string{tpl}, []string{partial}, []string{vars})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []lintFinding{
+		{"deprecated-function", lintWarning, partial, 1, 25, `function "date_modify" is deprecated, use "dateModify" instead`},
+		{"unknown-function", lintError, tpl, 1, 21, `function "frobnicate" is not defined`},
+		{"unbalanced-trim", lintWarning, tpl, 2, 1, "{{ end }} trims whitespace differently from {{- if }} at line 1"},
+		{"undefined-template", lintError, tpl, 2, 46, `template "missing" is not defined`},
+		{"missing-key", lintWarning, tpl, 3, 35, ".servers[].host is not set by the variables files"},
+		{"missing-key", lintWarning, tpl, 3, 58, ".db.host is not set by the variables files"},
+		{"missing-key", lintWarning, tpl, 3, 72, ".db.port is not set by the variables files"},
+		{"shell", lintWarning, tpl, 4, 4, "shell runs arbitrary commands"},
+	}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Errorf("lintTemplates broken behavior. Expected:\n%v\nGot:\n%v", expected, findings)
+	}
+}
+
+func TestLintTemplatesParseError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.tpl")
+	if err := os.WriteFile(path, []byte("ok\n{{ if }}"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	findings, err := lintTemplates([]string{path}, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []lintFinding{{"parse-error", lintError, path, 2, 0, "missing value for if"}}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Errorf("lintTemplates broken behavior. Expected: %v Got: %v", expected, findings)
+	}
+}
+
+func TestSarifLogRegions(t *testing.T) {
+	log := sarifLog([]lintFinding{
+		{"unknown-function", lintError, "a.tpl", 2, 4, "function \"f\" is not defined"},
+		{"parse-error", lintError, "b.tpl", 0, 0, "unexpected EOF"},
+	})
+	results := log["runs"].([]interface{})[0].(map[string]interface{})["results"].([]interface{})
+	expected := []interface{}{
+		map[string]interface{}{"startLine": 2, "startColumn": 4},
+		nil,
+	}
+	for i, result := range results {
+		locations := result.(map[string]interface{})["locations"].([]interface{})
+		physical := locations[0].(map[string]interface{})["physicalLocation"].(map[string]interface{})
+		region, ok := physical["region"]
+		if !reflect.DeepEqual(region, expected[i]) || ok != (expected[i] != nil) {
+			t.Errorf("sarifLog broken behavior for result %d. Expected region: %v Got: %v", i, expected[i], region)
+		}
+	}
+}
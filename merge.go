@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// deleteMarker as a value removes the key from the merged variables.
+	deleteMarker = "~delete"
+
+	// mergeDirectivesKey holds per-key merge strategies in a variables map,
+	// e.g. `~merge: {containers: "merge:name"}`.
+	mergeDirectivesKey = "~merge"
+)
+
+// mergeStrategy decides how a list is combined with the list it overrides.
+type mergeStrategy struct {
+	// kind is one of "replace", "append" or "merge".
+	kind string
+	// key names the field identifying entries when kind is "merge".
+	key string
+	// directives applies the ~delete and ~merge directives and the null
+	// values of src, which only variables files may use.
+	directives bool
+}
+
+var defaultMergeStrategy = mergeStrategy{kind: "replace"}
+
+// withDirectives returns s applying the directives of variables files.
+func (s mergeStrategy) withDirectives() mergeStrategy {
+	s.directives = true
+	return s
+}
+
+// parseMergeStrategy parses "replace", "append" or "merge:FIELD".
+func parseMergeStrategy(s string) (mergeStrategy, error) {
+	switch {
+	case s == "replace" || s == "append":
+		return mergeStrategy{kind: s}, nil
+	case strings.HasPrefix(s, "merge:") && len(s) > len("merge:"):
+		return mergeStrategy{kind: "merge", key: strings.TrimPrefix(s, "merge:")}, nil
+	}
+	return mergeStrategy{}, fmt.Errorf("invalid merge strategy %q: must be replace, append or merge:FIELD", s)
+}
+
+// mergeVars deep merges src into dst, with values from src taking
+// precedence. Maps are merged recursively and lists are combined according to
+// strategy. When the strategy applies directives, lists are combined according
+// to the strategy given for their key in the ~merge directives of src instead,
+// and a null or ~delete value in src removes the key from dst.
+func mergeVars(dst, src map[string]interface{}, strategy mergeStrategy) error {
+	var directives map[string]mergeStrategy
+	if strategy.directives {
+		var err error
+		directives, err = mergeDirectives(src)
+		if err != nil {
+			return err
+		}
+	}
+
+	for key, srcVal := range src {
+		if strategy.directives && key == mergeDirectivesKey {
+			continue
+		}
+		dstVal, exists := dst[key]
+		if strategy.directives && (srcVal == deleteMarker || (srcVal == nil && exists)) {
+			delete(dst, key)
+			continue
+		}
+
+		listStrategy := strategy
+		if d, ok := directives[key]; ok {
+			listStrategy = d
+		}
+		merged, err := mergeValue(dstVal, srcVal, listStrategy, strategy)
+		if err != nil {
+			return err
+		}
+		dst[key] = merged
+	}
+	return nil
+}
+
+// mergeValue merges src over dst, using listStrategy if both are lists.
+func mergeValue(dst, src interface{}, listStrategy, strategy mergeStrategy) (interface{}, error) {
+	if srcMap, ok := toStringMap(src); ok {
+		dstMap, ok := toStringMap(dst)
+		if !ok {
+			dstMap = make(map[string]interface{})
+		}
+		if err := mergeVars(dstMap, srcMap, strategy); err != nil {
+			return nil, err
+		}
+		return dstMap, nil
+	}
+
+	srcList, ok := src.([]interface{})
+	if !ok {
+		return src, nil
+	}
+	dstList, ok := dst.([]interface{})
+	if !ok || listStrategy.kind == "replace" {
+		return copyList(srcList, strategy)
+	}
+
+	if listStrategy.kind == "append" {
+		items, err := copyList(srcList, strategy)
+		if err != nil {
+			return nil, err
+		}
+		return append(append([]interface{}{}, dstList...), items...), nil
+	}
+	return mergeListByKey(dstList, srcList, listStrategy.key, strategy)
+}
+
+// mergeListByKey merges the entries of src into the entries of dst that have
+// the same value for key. Other entries of src are appended.
+func mergeListByKey(dst, src []interface{}, key string, strategy mergeStrategy) (interface{}, error) {
+	result := append([]interface{}{}, dst...)
+	for _, item := range src {
+		i := -1
+		if id, ok := listEntryKey(item, key); ok {
+			for j, existing := range result {
+				if existingID, ok := listEntryKey(existing, key); ok && existingID == id {
+					i = j
+					break
+				}
+			}
+		}
+
+		if i < 0 {
+			merged, err := mergeValue(nil, item, strategy, strategy)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, merged)
+			continue
+		}
+		merged, err := mergeValue(result[i], item, strategy, strategy)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = merged
+	}
+	return result, nil
+}
+
+// listEntryKey returns the value of key for a list entry which is a map.
+func listEntryKey(item interface{}, key string) (string, bool) {
+	m, ok := toStringMap(item)
+	if !ok {
+		return "", false
+	}
+	v, ok := m[key]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%v", v), true
+}
+
+// copyList copies a list, normalizing the maps within it.
+func copyList(list []interface{}, strategy mergeStrategy) ([]interface{}, error) {
+	result := make([]interface{}, len(list))
+	for i, item := range list {
+		v, err := mergeValue(nil, item, strategy, strategy)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+// mergeDirectives reads the ~merge directives of a variables map.
+func mergeDirectives(vars map[string]interface{}) (map[string]mergeStrategy, error) {
+	raw, ok := vars[mergeDirectivesKey]
+	if !ok {
+		return nil, nil
+	}
+	m, ok := toStringMap(raw)
+	if !ok {
+		return nil, fmt.Errorf("invalid %s directive: must map keys to merge strategies", mergeDirectivesKey)
+	}
+
+	directives := make(map[string]mergeStrategy, len(m))
+	for key, v := range m {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s directive for %s: must be a string", mergeDirectivesKey, key)
+		}
+		strategy, err := parseMergeStrategy(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s directive for %s: %v", mergeDirectivesKey, key, err)
+		}
+		directives[key] = strategy
+	}
+	return directives, nil
+}
+
+// toStringMap returns v as a map with string keys, converting the
+// map[interface{}]interface{} maps produced by the YAML decoder.
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			result[fmt.Sprintf("%v", k)] = v
+		}
+		return result, true
+	}
+	return nil, false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMergeStrategy(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected mergeStrategy
+		wantErr  bool
+	}{
+		{"replace", mergeStrategy{kind: "replace"}, false},
+		{"append", mergeStrategy{kind: "append"}, false},
+		{"merge:name", mergeStrategy{kind: "merge", key: "name"}, false},
+		{"merge:", mergeStrategy{}, true},
+		{"", mergeStrategy{}, true},
+		{"prepend", mergeStrategy{}, true},
+	}
+	for _, tt := range tests {
+		s, err := parseMergeStrategy(tt.in)
+		if (err != nil) != tt.wantErr || s != tt.expected {
+			t.Errorf("broken behavior for %q. Expected: %v Got: %v %v", tt.in, tt.expected, s, err)
+		}
+	}
+}
+
+func TestMergeVars(t *testing.T) {
+	base := func() map[string]interface{} {
+		return map[string]interface{}{
+			"name": "app",
+			"tags": []interface{}{"a"},
+			"containers": []interface{}{
+				map[interface{}]interface{}{"name": "web", "image": "web:1", "port": 80},
+				map[interface{}]interface{}{"name": "sidecar", "image": "proxy:1"},
+			},
+			"nested": map[interface{}]interface{}{"keep": "yes", "drop": "no"},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		strategy mergeStrategy
+		src      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			"replace",
+			mergeStrategy{kind: "replace", directives: true},
+			map[string]interface{}{"tags": []interface{}{"b"}, "nested": map[string]interface{}{"drop": nil}},
+			map[string]interface{}{
+				"name": "app",
+				"tags": []interface{}{"b"},
+				"containers": []interface{}{
+					map[string]interface{}{"name": "web", "image": "web:1", "port": 80},
+					map[string]interface{}{"name": "sidecar", "image": "proxy:1"},
+				},
+				"nested": map[string]interface{}{"keep": "yes"},
+			},
+		},
+		{
+			"append",
+			mergeStrategy{kind: "append", directives: true},
+			map[string]interface{}{"tags": []interface{}{"b"}, "name": "~delete"},
+			map[string]interface{}{
+				"tags": []interface{}{"a", "b"},
+				"containers": []interface{}{
+					map[string]interface{}{"name": "web", "image": "web:1", "port": 80},
+					map[string]interface{}{"name": "sidecar", "image": "proxy:1"},
+				},
+				"nested": map[string]interface{}{"keep": "yes", "drop": "no"},
+			},
+		},
+		{
+			"directives",
+			mergeStrategy{kind: "replace", directives: true},
+			map[string]interface{}{
+				"~merge": map[interface{}]interface{}{"containers": "merge:name", "tags": "append"},
+				"tags":   []interface{}{"b"},
+				"containers": []interface{}{
+					map[interface{}]interface{}{"name": "web", "image": "web:2", "port": "~delete"},
+					map[interface{}]interface{}{"name": "db", "image": "db:1"},
+				},
+			},
+			map[string]interface{}{
+				"name": "app",
+				"tags": []interface{}{"a", "b"},
+				"containers": []interface{}{
+					map[string]interface{}{"name": "web", "image": "web:2"},
+					map[string]interface{}{"name": "sidecar", "image": "proxy:1"},
+					map[string]interface{}{"name": "db", "image": "db:1"},
+				},
+				"nested": map[string]interface{}{"keep": "yes", "drop": "no"},
+			},
+		},
+		{
+			"without directives",
+			mergeStrategy{kind: "replace"},
+			map[string]interface{}{
+				"~merge": map[string]interface{}{"tags": "append"},
+				"tags":   []interface{}{"b"},
+				"name":   "~delete",
+				"nested": map[string]interface{}{"drop": nil},
+			},
+			map[string]interface{}{
+				"~merge": map[string]interface{}{"tags": "append"},
+				"name":   "~delete",
+				"tags":   []interface{}{"b"},
+				"containers": []interface{}{
+					map[string]interface{}{"name": "web", "image": "web:1", "port": 80},
+					map[string]interface{}{"name": "sidecar", "image": "proxy:1"},
+				},
+				"nested": map[string]interface{}{"keep": "yes", "drop": nil},
+			},
+		},
+	}
+	for _, tt := range tests {
+		vars := make(map[string]interface{})
+		if err := mergeVars(vars, base(), defaultMergeStrategy); err != nil {
+			t.Fatal(err)
+		}
+		if err := mergeVars(vars, tt.src, tt.strategy); err != nil {
+			t.Errorf("unexpected error for %s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(vars, tt.expected) {
+			t.Errorf("broken behavior for %s. Expected: %v Got: %v", tt.name, tt.expected, vars)
+		}
+	}
+}
+
+func TestMergeVarsInvalidDirective(t *testing.T) {
+	src := map[string]interface{}{
+		"~merge": map[string]interface{}{"tags": "prepend"},
+	}
+	if err := mergeVars(map[string]interface{}{}, src, defaultMergeStrategy.withDirectives()); err == nil {
+		t.Error("expected error for invalid directive")
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// missingKeyReport is a template option (-o) which renders missing variables
+// as zero values, reporting all of them once rendering is done.
+const missingKeyReport = "missingkey=report"
+
+// missingKeyFunc is the function the references to missing variables are
+// replaced with, see replaceMissingKeys.
+const missingKeyFunc = "gucciMissingKey"
+
+// missingKeyPattern matches the execution errors caused by a missing variable,
+// capturing the location and the field chain being evaluated.
+var missingKeyPattern = regexp.MustCompile(`template: ([^:]+:\d+:\d+): executing "[^"]*" at <([^>]*)>: (?:map has no entry for key|nil pointer evaluating)`)
+
+// missingKey is a variable referenced by a template but not set.
+type missingKey struct {
+	location string // template:line:column
+	key      string // the field chain, such as .db.host
+}
+
+func (k missingKey) String() string {
+	return k.location + ": " + k.key
+}
+
+// missingKeysError reports the variables found missing by missingkey=report.
+type missingKeysError struct {
+	keys []missingKey
+	// stopped is the missing key which could not be found before executing
+	// the template, when there is one, in which case nothing was rendered.
+	stopped *missingKey
+	// outdated is set when --check also found files out of date, which
+	// takes precedence for the exit code.
+	outdated *outdatedError
+}
+
+func (e *missingKeysError) Error() string {
+	lines := []string{fmt.Sprintf("%d missing variable(s):", len(e.keys))}
+	for _, k := range e.keys {
+		lines = append(lines, "  "+k.String())
+	}
+	if e.stopped != nil {
+		lines = append(lines, fmt.Sprintf("Stopped at %s: %s is missing but could not be traced to the variables, nothing was rendered", e.stopped.location, e.stopped.key))
+	}
+	if e.outdated != nil {
+		lines = append(lines, e.outdated.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *missingKeysError) Unwrap() error {
+	if e.outdated == nil {
+		return nil
+	}
+	return e.outdated
+}
+
+// setSources replaces the template names in the locations of the missing
+// keys with the paths of their files.
+func (e *missingKeysError) setSources(sources templateSources) {
+	for i := range e.keys {
+		e.keys[i].setSource(sources)
+	}
+	if e.stopped != nil {
+		e.stopped.setSource(sources)
+	}
+}
+
+func (k *missingKey) setSource(sources templateSources) {
+	name, line, column := splitLocation(k.location)
+	if src, ok := sources[name]; ok {
+		k.location = fmt.Sprintf("%s:%d:%d", src.path, line, column)
+	}
+}
+
+// missingKeyOption removes missingkey=report from the template options,
+// replacing it with missingkey=error, and returns whether it was given.
+func missingKeyOption(opt []string) ([]string, bool) {
+	var result []string
+	report := false
+	for _, o := range opt {
+		if o == missingKeyReport {
+			report = true
+			o = "missingkey=error"
+		}
+		result = append(result, o)
+	}
+	return result, report
+}
+
+// executeReportingMissingKeys executes tpl once, with the references to the
+// variables which are missing replaced by zero values: an empty string, or
+// nothing to range over. The output is written to out, and the missing
+// variables returned as a *missingKeysError. The variables themselves are left
+// untouched, so templates printing a map see only the keys it has.
+//
+// The variables referenced are found by analyzeTemplate, including those
+// relative to range and with. A missing variable it cannot follow, such as a
+// field of a function result, stops the execution.
+func executeReportingMissingKeys(valuesIn map[string]interface{}, out io.Writer, tpl *template.Template) error {
+	// Merging into an empty map copies the variables, which are filled in to
+	// find those missing.
+	vars := make(map[string]interface{})
+	err := mergeVars(vars, valuesIn, defaultMergeStrategy)
+	if err != nil {
+		return err
+	}
+
+	a := analyzeTemplate(tpl)
+	var keys []missingKey
+	for _, field := range a.Fields {
+		path, err := parseKeyPath(strings.TrimPrefix(field, "."))
+		if err != nil || belowMissingKey(field, keys) {
+			continue
+		}
+		if fillMissingKey(vars, path) {
+			keys = append(keys, missingKey{location: a.locations[field], key: field})
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].before(keys[j])
+	})
+
+	if len(keys) > 0 {
+		replaceMissingKeys(tpl, a, keys)
+	}
+
+	var b bytes.Buffer
+	err = tpl.Execute(&b, valuesIn)
+	if err != nil {
+		if key, _, ok := parseMissingKeyError(err); ok {
+			return &missingKeysError{keys: keys, stopped: &key}
+		}
+		return err
+	}
+	if _, err := b.WriteTo(out); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return &missingKeysError{keys: keys}
+	}
+	return nil
+}
+
+// fillMissingKey sets the variable at path in node to nil if it is missing,
+// creating the maps leading to it, and reports whether it did. A "[]" segment
+// fills every element of a list or map; a missing list has no elements to
+// fill.
+func fillMissingKey(node interface{}, path []keyPathSegment) bool {
+	seg := path[0]
+	if seg.isIndex {
+		filled := false
+		switch n := node.(type) {
+		case []interface{}:
+			for _, item := range n {
+				filled = fillElement(item, path[1:]) || filled
+			}
+		case map[string]interface{}:
+			for _, item := range n {
+				filled = fillElement(item, path[1:]) || filled
+			}
+		}
+		return filled
+	}
+
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	val, exists := m[seg.key]
+	if len(path) == 1 {
+		if !exists {
+			m[seg.key] = nil
+		}
+		return !exists
+	}
+	if val == nil && !path[1].isIndex {
+		// A map is needed for the fields below to be evaluated.
+		val = make(map[string]interface{})
+		m[seg.key] = val
+		if !exists {
+			fillMissingKey(val, path[1:])
+			return true
+		}
+	}
+	return fillMissingKey(val, path[1:])
+}
+
+// replaceMissingKeys rewrites the fields of the templates of tpl referencing
+// keys, or variables below them, into calls to missingKeyFunc, which yields
+// the zero value when the variable is missing.
+func replaceMissingKeys(tpl *template.Template, a *templateAnalysis, keys []missingKey) {
+	missing := func(node parse.Node) bool {
+		for _, path := range a.references[node] {
+			for _, k := range keys {
+				if path == k.key || belowMissingKey(path, []missingKey{k}) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	tpl.Funcs(template.FuncMap{missingKeyFunc: missingKeyValue})
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil {
+			replaceMissingNodes(t.Tree.Root, missing)
+		}
+	}
+}
+
+func replaceMissingNodes(node parse.Node, missing func(parse.Node) bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			replaceMissingNodes(child, missing)
+		}
+	case *parse.ActionNode:
+		replaceMissingPipe(n.Pipe, missing, false)
+	case *parse.IfNode:
+		replaceMissingPipe(n.Pipe, missing, false)
+		replaceMissingNodes(n.List, missing)
+		replaceMissingNodes(n.ElseList, missing)
+	case *parse.WithNode:
+		replaceMissingPipe(n.Pipe, missing, false)
+		replaceMissingNodes(n.List, missing)
+		replaceMissingNodes(n.ElseList, missing)
+	case *parse.RangeNode:
+		replaceMissingPipe(n.Pipe, missing, true)
+		replaceMissingNodes(n.List, missing)
+		replaceMissingNodes(n.ElseList, missing)
+	case *parse.TemplateNode:
+		replaceMissingPipe(n.Pipe, missing, false)
+	}
+}
+
+// replaceMissingPipe replaces the missing fields of a pipeline. A missing
+// field ranged over is replaced with nil rather than an empty string, which
+// cannot be ranged over.
+func replaceMissingPipe(p *parse.PipeNode, missing func(parse.Node) bool, ranged bool) {
+	if p == nil {
+		return
+	}
+	ranged = ranged && len(p.Cmds) == 1 && len(p.Cmds[0].Args) == 1
+	for _, cmd := range p.Cmds {
+		for i, arg := range cmd.Args {
+			if i == 0 && len(cmd.Args) > 1 {
+				// A field given arguments is a method call.
+				continue
+			}
+			switch n := arg.(type) {
+			case *parse.FieldNode:
+				if missing(n) {
+					cmd.Args[i] = missingKeyCall(&parse.DotNode{NodeType: parse.NodeDot, Pos: n.Pos}, n.Ident, n.Pos, ranged)
+				}
+			case *parse.VariableNode:
+				if len(n.Ident) > 1 && missing(n) {
+					base := &parse.VariableNode{NodeType: parse.NodeVariable, Pos: n.Pos, Ident: n.Ident[:1]}
+					cmd.Args[i] = missingKeyCall(base, n.Ident[1:], n.Pos, ranged)
+				}
+			case *parse.PipeNode:
+				replaceMissingPipe(n, missing, false)
+			case *parse.ChainNode:
+				if pipe, ok := n.Node.(*parse.PipeNode); ok {
+					replaceMissingPipe(pipe, missing, false)
+				}
+			}
+		}
+	}
+}
+
+// missingKeyCall returns the pipeline calling missingKeyFunc to look up
+// idents below base.
+func missingKeyCall(base parse.Node, idents []string, pos parse.Pos, ranged bool) *parse.PipeNode {
+	var zero parse.Node = &parse.StringNode{NodeType: parse.NodeString, Pos: pos, Quoted: `""`}
+	if ranged {
+		zero = &parse.NilNode{NodeType: parse.NodeNil, Pos: pos}
+	}
+	args := []parse.Node{parse.NewIdentifier(missingKeyFunc).SetPos(pos), zero, base}
+	for _, ident := range idents {
+		args = append(args, &parse.StringNode{NodeType: parse.NodeString, Pos: pos, Quoted: strconv.Quote(ident), Text: ident})
+	}
+	return &parse.PipeNode{
+		NodeType: parse.NodePipe,
+		Pos:      pos,
+		Cmds:     []*parse.CommandNode{{NodeType: parse.NodeCommand, Pos: pos, Args: args}},
+	}
+}
+
+// missingKeyValue returns the variable at keys below node, or zero when it is
+// missing.
+func missingKeyValue(zero, node interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return zero
+		}
+		node, ok = m[key]
+		if !ok {
+			return zero
+		}
+	}
+	return node
+}
+
+// belowMissingKey reports whether field is below one of keys. Such fields
+// are left missing, so that with and if skip them as they would when their
+// parent is missing.
+func belowMissingKey(field string, keys []missingKey) bool {
+	for _, k := range keys {
+		if strings.HasPrefix(field, k.key+".") || strings.HasPrefix(field, k.key+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+func fillElement(item interface{}, path []keyPathSegment) bool {
+	if len(path) == 0 {
+		return false
+	}
+	return fillMissingKey(item, path)
+}
+
+// before reports whether k is located before other, ordering by template,
+// then line and column.
+func (k missingKey) before(other missingKey) bool {
+	name, line, column := splitLocation(k.location)
+	otherName, otherLine, otherColumn := splitLocation(other.location)
+	if name != otherName {
+		return name < otherName
+	}
+	if line != otherLine {
+		return line < otherLine
+	}
+	return column < otherColumn
+}
+
+// splitLocation splits a template:line:column location.
+func splitLocation(location string) (string, int, int) {
+	parts := strings.Split(location, ":")
+	n := len(parts)
+	if n < 3 {
+		return location, 0, 0
+	}
+	line, _ := strconv.Atoi(parts[n-2])
+	column, _ := strconv.Atoi(parts[n-1])
+	return strings.Join(parts[:n-2], ":"), line, column
+}
+
+// parseMissingKeyError returns the missing variable causing an execution
+// error, and its path from the root variables. For errors raised within an
+// include, the innermost location is used.
+func parseMissingKeyError(err error) (missingKey, []keyPathSegment, bool) {
+	matches := missingKeyPattern.FindAllStringSubmatch(err.Error(), -1)
+	if len(matches) == 0 {
+		return missingKey{}, nil, false
+	}
+	m := matches[len(matches)-1]
+	key := missingKey{location: templateLocation(m[1]), key: strings.TrimPrefix(m[2], "$")}
+
+	if !strings.HasPrefix(key.key, ".") {
+		return missingKey{}, nil, false
+	}
+	var path []keyPathSegment
+	for _, field := range strings.Split(key.key[1:], ".") {
+		if field == "" || strings.ContainsAny(field, " ()|") {
+			return missingKey{}, nil, false
+		}
+		path = append(path, keyPathSegment{key: field})
+	}
+	return key, path, true
+}
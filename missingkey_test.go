@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMissingKeysErrorSetSources(t *testing.T) {
+	e := &missingKeysError{
+		keys:    []missingKey{{"q.tpl:1:4", ".a"}, {"p.tpl:2:1", ".b"}, {"-:1:1", ".c"}},
+		stopped: &missingKey{"q.tpl:3:2", ".d"},
+	}
+	e.setSources(templateSources{
+		"q.tpl": {path: "sub/q.tpl"},
+		"p.tpl": {path: "partials/p.tpl"},
+	})
+
+	expected := &missingKeysError{
+		keys:    []missingKey{{"sub/q.tpl:1:4", ".a"}, {"partials/p.tpl:2:1", ".b"}, {"-:1:1", ".c"}},
+		stopped: &missingKey{"sub/q.tpl:3:2", ".d"},
+	}
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("setSources broken behavior. Expected: %v Got: %v", expected, e)
+	}
+}
+
+func TestMissingKeyOption(t *testing.T) {
+	opt, report := missingKeyOption([]string{"missingkey=report", "foo=bar"})
+	if !report || !reflect.DeepEqual(opt, []string{"missingkey=error", "foo=bar"}) {
+		t.Errorf("missingKeyOption broken behavior. Got: %v, %v", opt, report)
+	}
+	opt, report = missingKeyOption([]string{"missingkey=zero"})
+	if report || !reflect.DeepEqual(opt, []string{"missingkey=zero"}) {
+		t.Errorf("missingKeyOption broken behavior. Got: %v, %v", opt, report)
+	}
+}
+
+func TestExecuteReportingMissingKeys(t *testing.T) {
+	tests := []struct {
+		tpl      string
+		expected string
+		missing  []missingKey
+		stopped  *missingKey
+	}{
+		{
+			tpl:      "{{ .FOO }}",
+			expected: "bar",
+		},
+		{
+			tpl:      "{{ .a }}-{{ .FOO }}\n{{ $.db.host }}{{ .db.port }}{{ .a }}",
+			expected: "-bar\n",
+			missing: []missingKey{
+				{"test:1:4", ".a"},
+				{"test:2:5", ".db.host"},
+				{"test:2:22", ".db.port"},
+			},
+		},
+		{
+			tpl:      `{{ define "x" }}{{ .b }}{{ end }}{{ include "x" . }}`,
+			expected: "",
+			missing: []missingKey{
+				{"test:1:20", ".b"},
+			},
+		},
+		{
+			tpl:      "{{ .a }}{{ range .list }}{{ .name }}{{ .port }}{{ end }}{{ .b }}",
+			expected: "a",
+			missing: []missingKey{
+				{"test:1:4", ".a"},
+				{"test:1:40", ".list[].port"},
+				{"test:1:60", ".b"},
+			},
+		},
+		{
+			tpl:      "{{ with .db }}{{ .host }}{{ end }}|{{ range .servers }}{{ .port }}{{ end }}",
+			expected: "|",
+			missing: []missingKey{
+				{"test:1:9", ".db"},
+				{"test:1:45", ".servers"},
+			},
+		},
+		{
+			tpl:      "{{ range .list }}{{ .tag.name }}{{ end }} {{ .list }} {{ len .b }}",
+			expected: " [map[name:a]] 0",
+			missing: []missingKey{
+				{"test:1:25", ".list[].tag.name"},
+				{"test:1:62", ".b"},
+			},
+		},
+		{
+			tpl:     `{{ .a }}{{ with dict "x" 1 }}{{ .y }}{{ end }}`,
+			missing: []missingKey{{"test:1:4", ".a"}},
+			stopped: &missingKey{"test:1:33", ".y"},
+		},
+	}
+	for _, tt := range tests {
+		tpl, err := loadTemplateString("test", tt.tpl)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tpl.Option("missingkey=error")
+		vars := map[string]interface{}{
+			"FOO":  "bar",
+			"list": []interface{}{map[string]interface{}{"name": "a"}},
+		}
+
+		var b bytes.Buffer
+		err = executeReportingMissingKeys(vars, &b, tpl)
+		var missing *missingKeysError
+		if errors.As(err, &missing) {
+			if !reflect.DeepEqual(missing.keys, tt.missing) || !reflect.DeepEqual(missing.stopped, tt.stopped) {
+				t.Errorf("%q broken behavior. Expected: %v, %v Got: %v, %v", tt.tpl, tt.missing, tt.stopped, missing.keys, missing.stopped)
+			}
+		} else if err != nil || tt.missing != nil || tt.stopped != nil {
+			t.Errorf("%q broken behavior. Expected: %v, %v Got: %v", tt.tpl, tt.missing, tt.stopped, err)
+		}
+		if b.String() != tt.expected {
+			t.Errorf("%q broken behavior. Expected: %q Got: %q", tt.tpl, tt.expected, b.String())
+		}
+		first := vars["list"].([]interface{})[0].(map[string]interface{})
+		if _, ok := vars["a"]; ok || len(first) != 1 {
+			t.Errorf("%q broken behavior. Expected the variables to be left unchanged", tt.tpl)
+		}
+	}
+}
+
+func TestExecuteReportingMissingKeysOnce(t *testing.T) {
+	count := filepath.Join(t.TempDir(), "count")
+	tpl, err := loadTemplateString("test", `{{ shell "echo ran >> `+count+`" }}{{ .a }}{{ .b }}{{ .c }}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tpl.Option("missingkey=error")
+
+	err = executeReportingMissingKeys(map[string]interface{}{}, &bytes.Buffer{}, tpl)
+	var missing *missingKeysError
+	if !errors.As(err, &missing) || len(missing.keys) != 3 {
+		t.Errorf("executeReportingMissingKeys broken behavior. Expected 3 missing keys Got: %v", err)
+	}
+	content, _ := os.ReadFile(count)
+	if string(content) != "ran\n" {
+		t.Errorf("executeReportingMissingKeys broken behavior. Expected a single execution Got: %q", content)
+	}
+}
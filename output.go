@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// spoolThreshold is the amount of rendered output held in memory before it is
+// spilled to a temporary file.
+const spoolThreshold = 1 << 20
+
+// spool collects output so that it can be emitted only once rendering has
+// succeeded. Data is buffered in memory until it grows past threshold, after
+// which it is spilled to a temporary file.
+type spool struct {
+	buf       bytes.Buffer
+	file      *os.File
+	threshold int
+}
+
+func newSpool() *spool {
+	return &spool{threshold: spoolThreshold}
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(p) > s.threshold {
+		f, err := os.CreateTemp("", "gucci-*")
+		if err != nil {
+			return 0, fmt.Errorf("Error creating spool file: %v", err)
+		}
+		s.file = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	if s.file != nil {
+		return s.file.Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+// WriteTo copies everything written to the spool so far into w.
+func (s *spool) WriteTo(w io.Writer) (int64, error) {
+	if s.file == nil {
+		return s.buf.WriteTo(w)
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.file)
+}
+
+// Close releases the temporary file backing the spool, if any.
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// renderedFile is the output of a rendered (or copied) file, held until every
+// file has rendered successfully. A renderedFile without content stands for a
+// directory.
+type renderedFile struct {
+	path    string // empty for standard output
+	mode    os.FileMode
+	content *spool
+	// missing holds the variables reported missing by missingkey=report.
+	missing []missingKey
+}
+
+func newRenderedFile(path string, mode os.FileMode) *renderedFile {
+	return &renderedFile{path: path, mode: mode, content: newSpool()}
+}
+
+// write emits the rendered content to its destination.
+func (f *renderedFile) write() error {
+	if f.content == nil {
+		if err := os.MkdirAll(f.path, f.mode); err != nil {
+			return fmt.Errorf("Error creating output directory: %v", err)
+		}
+		return nil
+	}
+	if f.path == "" {
+		_, err := f.content.WriteTo(os.Stdout)
+		return err
+	}
+	return writeFileAtomic(f.path, f.mode, func(w io.Writer) error {
+		_, err := f.content.WriteTo(w)
+		return err
+	})
+}
+
+// diff returns a unified diff between the current destination and the
+// rendered content, or an empty string when they are identical.
+func (f *renderedFile) diff() (string, error) {
+	if f.content == nil {
+		if isDir(f.path) {
+			return "", nil
+		}
+		return fmt.Sprintf("directory %s does not exist\n", f.path), nil
+	}
+
+	var rendered bytes.Buffer
+	if _, err := f.content.WriteTo(&rendered); err != nil {
+		return "", err
+	}
+
+	fromFile := f.path
+	existing, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		fromFile = "/dev/null"
+	} else if err != nil {
+		return "", err
+	}
+	if bytes.Equal(existing, rendered.Bytes()) {
+		return "", nil
+	}
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        diffLines(string(existing)),
+		B:        diffLines(rendered.String()),
+		FromFile: fromFile,
+		ToFile:   f.path,
+		Context:  3,
+	})
+}
+
+// diffLines splits s into lines for a diff. difflib.SplitLines adds a blank
+// line after a trailing newline, so a missing trailing newline is marked as
+// diff does instead.
+func diffLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if last := len(lines) - 1; lines[last] == "" {
+		lines = lines[:last]
+	} else {
+		lines[last] += "\n\\ No newline at end of file\n"
+	}
+	return lines
+}
+
+func (f *renderedFile) Close() error {
+	if f.content == nil {
+		return nil
+	}
+	return f.content.Close()
+}
+
+// copyFile reads src into a renderedFile destined for dest.
+func copyFile(src, dest string, mode os.FileMode) (*renderedFile, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	f := newRenderedFile(dest, mode)
+	if _, err := io.Copy(f.content, in); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error copying %s: %v", src, err)
+	}
+	return f, nil
+}
+
+// parseFileMode parses an octal file mode such as "0644".
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q: must be octal, e.g. 0644", s)
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("invalid file mode %q: only permission bits may be set", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// writeFileAtomic writes the content produced by write to path. Parent
+// directories are created as needed and the content is written to a temporary
+// file in the same directory which is renamed into place once complete, so the
+// target is either left untouched or fully replaced.
+func writeFileAtomic(path string, mode os.FileMode, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Error creating output directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("Error creating output file: %v", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return fmt.Errorf("Error writing output file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("Error writing output file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error writing output file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Error writing output file: %v", err)
+	}
+	committed = true
+	return nil
+}
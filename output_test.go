@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		mode    os.FileMode
+		wantErr bool
+	}{
+		{"0644", 0644, false},
+		{"600", 0600, false},
+		{"0755", 0755, false},
+		{"0999", 0, true},
+		{"rw", 0, true},
+		{"4755", 0, true},
+	}
+	for _, tt := range tests {
+		mode, err := parseFileMode(tt.in)
+		if (err != nil) != tt.wantErr || mode != tt.mode {
+			t.Errorf("broken behavior. Expected: %#v Got: %v %v", tt, mode, err)
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+	for _, threshold := range []int{1 << 20, 4} {
+		s := &spool{threshold: threshold}
+		for _, chunk := range []string{"ab", "cde", "fghij"} {
+			if _, err := s.Write([]byte(chunk)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var b bytes.Buffer
+		if _, err := s.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != "abcdefghij" {
+			t.Errorf("broken behavior with threshold %d. Expected: %v Got: %v", threshold, "abcdefghij", b.String())
+		}
+		if (s.file != nil) != (threshold == 4) {
+			t.Errorf("broken behavior with threshold %d. Unexpected spill to file: %v", threshold, s.file != nil)
+		}
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected []string
+	}{
+		{"", nil},
+		{"a\n", []string{"a\n"}},
+		{"a\nb\n", []string{"a\n", "b\n"}},
+		{"a\nb", []string{"a\n", "b\n\\ No newline at end of file\n"}},
+	}
+	for _, tt := range tests {
+		if actual := diffLines(tt.in); !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("diffLines(%q) broken behavior. Expected: %q Got: %q", tt.in, tt.expected, actual)
+		}
+	}
+}
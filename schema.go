@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// validateVars validates vars against the JSON Schema in schemaPath, first
+// setting missing variables to their schema defaults if applyDefaults is set.
+//
+// Only local files are loaded, both for the schema and the schemas it
+// references with $ref.
+func validateVars(vars map[string]interface{}, schemaPath string, applyDefaults bool) error {
+	compiler := jsonschema.NewCompiler()
+	compiler.ExtractAnnotations = true
+	compiler.LoadURL = loadLocalSchema
+	schema, err := compiler.Compile(schemaPath)
+	if err != nil {
+		return fmt.Errorf("Error loading schema %s: %v", schemaPath, err)
+	}
+
+	if applyDefaults {
+		applySchemaDefaults(schema, vars)
+	}
+
+	// The validator expects values as decoded by encoding/json, so the
+	// variables are converted by a round trip through JSON.
+	data, err := json.Marshal(convertToJSONCompatible(vars))
+	if err != nil {
+		return fmt.Errorf("Error validating variables: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("Error validating variables: %v", err)
+	}
+
+	err = schema.Validate(doc)
+	if verr, ok := err.(*jsonschema.ValidationError); ok {
+		lines := []string{fmt.Sprintf("Variables do not match the schema %s:", schemaPath)}
+		for _, v := range schemaViolations(verr) {
+			lines = append(lines, fmt.Sprintf("  '%s': %s", v.InstanceLocation, v.Message))
+		}
+		return fmt.Errorf("%s", strings.Join(lines, "\n"))
+	}
+	if err != nil {
+		return fmt.Errorf("Error validating variables: %v", err)
+	}
+	return nil
+}
+
+// loadLocalSchema loads schemas from file URLs only, so that validating never
+// reaches out to the network.
+func loadLocalSchema(url string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(url, "file://") {
+		return nil, fmt.Errorf("only local schema files can be loaded, not %s", url)
+	}
+	return jsonschema.Loaders["file"](url)
+}
+
+// schemaViolations returns the individual violations causing err, dropping
+// the errors which merely group them.
+func schemaViolations(err *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(err.Causes) == 0 {
+		return []*jsonschema.ValidationError{err}
+	}
+	var violations []*jsonschema.ValidationError
+	for _, cause := range err.Causes {
+		violations = append(violations, schemaViolations(cause)...)
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].InstanceLocation < violations[j].InstanceLocation
+	})
+	return violations
+}
+
+// applySchemaDefaults sets the properties missing from v, and the maps and
+// lists within it, to their defaults in schema.
+func applySchemaDefaults(schema *jsonschema.Schema, v interface{}) {
+	if schema == nil {
+		return
+	}
+	applySchemaDefaults(schema.Ref, v)
+	for _, s := range schema.AllOf {
+		applySchemaDefaults(s, v)
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}, map[interface{}]interface{}:
+		m, _ := toStringMap(val)
+		for key, prop := range schema.Properties {
+			if item, ok := m[key]; ok {
+				applySchemaDefaults(prop, item)
+			} else if def := schemaDefault(prop); def != nil {
+				setMapKey(val, key, fromJSONValue(def))
+			}
+		}
+	case []interface{}:
+		items, _ := schema.Items.(*jsonschema.Schema)
+		if schema.Items2020 != nil {
+			items = schema.Items2020
+		}
+		for _, item := range val {
+			applySchemaDefaults(items, item)
+		}
+	}
+}
+
+// schemaDefault returns the default of schema, following $ref.
+func schemaDefault(schema *jsonschema.Schema) interface{} {
+	for ; schema != nil; schema = schema.Ref {
+		if schema.Default != nil {
+			return schema.Default
+		}
+	}
+	return nil
+}
+
+func setMapKey(m interface{}, key string, val interface{}) {
+	switch m := m.(type) {
+	case map[string]interface{}:
+		m[key] = val
+	case map[interface{}]interface{}:
+		m[key] = val
+	}
+}
+
+// fromJSONValue converts the numbers in a value decoded by the schema
+// compiler into ints or floats, as found in variables files.
+func fromJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			result[k] = fromJSONValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = fromJSONValue(item)
+		}
+		return result
+	}
+	return v
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeSchema(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return path
+}
+
+func TestValidateVars(t *testing.T) {
+	dir := t.TempDir()
+	writeSchema(t, dir, "common.json", `{"$defs": {"port": {"type": "integer", "default": 80}}}`)
+	schema := writeSchema(t, dir, "schema.json", `{
+		"type": "object",
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string"},
+			"env": {"enum": ["dev", "prod"], "default": "dev"},
+			"servers": {
+				"type": "array",
+				"items": {"properties": {"port": {"$ref": "common.json#/$defs/port"}}}
+			}
+		}
+	}`)
+
+	vars := map[string]interface{}{
+		"name":    "app",
+		"servers": []interface{}{map[interface{}]interface{}{"host": "a"}},
+	}
+	if err := validateVars(vars, schema, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"name":    "app",
+		"env":     "dev",
+		"servers": []interface{}{map[interface{}]interface{}{"host": "a", "port": 80}},
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("validateVars broken behavior. Expected: %v Got: %v", expected, vars)
+	}
+
+	vars = map[string]interface{}{
+		"env":     "qa",
+		"servers": []interface{}{map[string]interface{}{"port": "80"}},
+	}
+	err := validateVars(vars, schema, false)
+	expectedErr := "Variables do not match the schema " + schema + `:
+  '': missing properties: 'name'
+  '/env': value must be one of "dev", "prod"
+  '/servers/0/port': expected integer, but got string`
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("validateVars broken behavior. Expected: %s Got: %v", expectedErr, err)
+	}
+}
+
+func TestValidateVarsOffline(t *testing.T) {
+	schema := writeSchema(t, t.TempDir(), "schema.json", `{"$ref": "https://example.com/schema.json"}`)
+	err := validateVars(map[string]interface{}{}, schema, false)
+	if err == nil {
+		t.Errorf("validateVars broken behavior. Expected an error loading a remote schema")
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	sourceFile = "file"
+	sourceEnv  = "env"
+	sourceSet  = "set"
+)
+
+// defaultPrecedence orders the kinds of variable sources from lowest to
+// highest precedence.
+var defaultPrecedence = []string{sourceFile, sourceEnv, sourceSet}
+
+// varSource is a single source of variables, applied on top of the sources
+// with lower precedence.
+type varSource struct {
+	kind  string
+	name  string
+	apply func(vars map[string]interface{}) error
+	// line returns the line setting the key at path, or 0 when unknown. It
+	// is only valid once the source has been applied, and may be nil.
+	line func(path []keyPathSegment) int
+}
+
+// setVarFlags lists the flags setting single variables along with how their
+// values are parsed.
+var setVarFlags = []struct {
+	name  string
+	parse func(string) (interface{}, error)
+}{
+	{flagSetJSON, parseJSONValue},
+	{flagSetTyped, parseTypedValue},
+	{flagSetVar, parseStringValue},
+	{flagSetString, parseStringValue},
+	{flagSetFile, readFileValue},
+	{flagSetFileBase64, readFileBase64Value},
+}
+
+// variableSources returns the variable sources selected by the command line,
+// ordered from lowest to highest precedence. args holds the raw command line
+// arguments, used to apply variables files and options in the order they were
+// given, including those given before the name of a command.
+func variableSources(c *cli.Context, args []string) ([]varSource, error) {
+	strategy, err := parseMergeStrategy(optionString(c, flagMergeStrategy))
+	if err != nil {
+		return nil, err
+	}
+	order, err := parsePrecedence(optionString(c, flagPrecedence))
+	if err != nil {
+		return nil, err
+	}
+	envMode, err := parseEnvMode(optionString(c, flagEnvMode))
+	if err != nil {
+		return nil, err
+	}
+	envOpts := envOptions{
+		mode:      envMode,
+		prefix:    optionString(c, flagEnvPrefix),
+		separator: optionString(c, flagEnvSeparator),
+
+		resolveFiles: optionBool(c, flagEnvFiles),
+		filesAllow:   optionStringSlice(c, flagEnvFilesAllow),
+		filesDeny:    optionStringSlice(c, flagEnvFilesDeny),
+	}
+
+	var files, sets []varSource
+	given := argSources(c.App.Flags, args, strategy)
+	if c.Command.Name != "" {
+		rest := commandArgs(args, c.App.Flags, c.Command.Name)
+		given = append(given, argSources(c.Command.Flags, rest, strategy)...)
+	}
+	if optionBool(c, flagInterleave) {
+		// Files and options form a single group, taking the place of
+		// whichever of the two has the higher precedence.
+		if indexOf(order, sourceFile) > indexOf(order, sourceSet) {
+			files = given
+		} else {
+			sets = given
+		}
+	} else {
+		for _, source := range given {
+			if source.kind == sourceFile {
+				files = append(files, source)
+			} else {
+				sets = append(sets, source)
+			}
+		}
+	}
+
+	var sources []varSource
+	for _, kind := range order {
+		switch kind {
+		case sourceFile:
+			sources = append(sources, files...)
+		case sourceEnv:
+			if envOpts.mode != envModeNone {
+				sources = append(sources, envSource(envOpts, strategy))
+			}
+		case sourceSet:
+			sources = append(sources, sets...)
+		}
+	}
+	return sources, nil
+}
+
+// parsePrecedence parses a comma separated ordering of the variable source
+// kinds, such as "env,file,set".
+func parsePrecedence(s string) ([]string, error) {
+	order := strings.Split(s, ",")
+	for i := range order {
+		order[i] = strings.TrimSpace(order[i])
+	}
+	valid := len(order) == len(defaultPrecedence)
+	for _, kind := range defaultPrecedence {
+		if indexOf(order, kind) < 0 {
+			valid = false
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid precedence %q: must list each of %s exactly once", s, strings.Join(defaultPrecedence, ", "))
+	}
+	return order, nil
+}
+
+// fileSource loads a variables file. The file is read once, so that a file
+// read from standard input may be applied more than once.
+func fileSource(arg string, strategy mergeStrategy) varSource {
+	var f *varsFile
+	var v map[string]interface{}
+	return varSource{
+		kind: sourceFile,
+		name: "file " + arg,
+		apply: func(vars map[string]interface{}) error {
+			if f == nil {
+				file, err := readVarsFile(arg)
+				if err != nil {
+					return err
+				}
+				v, err = file.parse()
+				if err != nil {
+					return err
+				}
+				f = file
+			}
+			err := mergeVars(vars, v, strategy.withDirectives())
+			if err != nil {
+				return fmt.Errorf("Error merging variables file %s: %v", arg, err)
+			}
+			return nil
+		},
+		line: func(path []keyPathSegment) int {
+			if f == nil {
+				return 0
+			}
+			return f.keyLine(path)
+		},
+	}
+}
+
+func envSource(opts envOptions, strategy mergeStrategy) varSource {
+	name := "environment"
+	if opts.prefix != "" {
+		name += " " + opts.prefix + "*"
+	}
+	if opts.mode == envModeNamespaced {
+		name += " as ." + envNamespace
+	}
+	return varSource{
+		kind: sourceEnv,
+		name: name,
+		apply: func(vars map[string]interface{}) error {
+			v, err := envVars(opts)
+			if err != nil {
+				return err
+			}
+			return mergeVars(vars, v, strategy)
+		},
+	}
+}
+
+// setSource sets a single variable given as an option. The value is set in
+// place, so setting a list element or a nested key keeps the rest of a list
+// or map loaded from a vars file.
+func setSource(flag, varStr string, parse func(string) (interface{}, error)) varSource {
+	name := flagDisplayName(flag)
+	return varSource{
+		kind: sourceSet,
+		name: name + " " + varStr,
+		apply: func(vars map[string]interface{}) error {
+			key, str := getKeyVal(varStr)
+			path, err := parseKeyPath(key)
+			if err != nil {
+				return err
+			}
+			val, err := parse(str)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s %s: %v", name, key, err)
+			}
+			setKeyPath(vars, path, val)
+			return nil
+		},
+	}
+}
+
+// argSources returns the variables files and options found in args in the
+// order they were given. As with the flags themselves, the scan stops at the
+// first argument which is not a flag.
+func argSources(flags []cli.Flag, args []string, strategy mergeStrategy) []varSource {
+	byName := flagsByName(flags)
+	parsers := make(map[string]func(string) (interface{}, error))
+	for _, flag := range setVarFlags {
+		parsers[flag.name] = flag.parse
+	}
+
+	var sources []varSource
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f, ok := byName[name]
+		if !ok {
+			continue
+		}
+		if !hasValue {
+			if isBoolFlag(f) || i+1 == len(args) {
+				continue
+			}
+			i++
+			value = args[i]
+		}
+
+		canonical := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+		if canonical == flagVarsFile {
+			if value != "" {
+				sources = append(sources, fileSource(value, strategy))
+			}
+		} else if parse, ok := parsers[canonical]; ok {
+			sources = append(sources, setSource(canonical, value, parse))
+		}
+	}
+	return sources
+}
+
+// commandArgs returns the arguments following the command called name in
+// args, skipping the global flags before it and their values, or nil when
+// the first positional argument is not the command.
+func commandArgs(args []string, globalFlags []cli.Flag, name string) []string {
+	byName := flagsByName(globalFlags)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return nil
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			if arg == name {
+				return args[i+1:]
+			}
+			return nil
+		}
+		flagName, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if f, ok := byName[flagName]; ok && !hasValue && !isBoolFlag(f) {
+			i++
+		}
+	}
+	return nil
+}
+
+// optionString returns the value of a string flag. The variable flags are
+// accepted both before and after the name of a command, the value given after
+// it winning.
+func optionString(c *cli.Context, name string) string {
+	if !c.IsSet(name) && c.GlobalIsSet(name) {
+		return c.GlobalString(name)
+	}
+	return c.String(name)
+}
+
+// optionBool returns whether a boolean flag is set before or after the name of
+// a command.
+func optionBool(c *cli.Context, name string) bool {
+	return c.Bool(name) || c.GlobalBool(name)
+}
+
+// optionStringSlice returns the values of a string slice flag, those given
+// before the name of a command first.
+func optionStringSlice(c *cli.Context, name string) []string {
+	if c.Command.Name == "" {
+		return c.StringSlice(name)
+	}
+	return append(c.GlobalStringSlice(name), c.StringSlice(name)...)
+}
+
+// flagsByName maps each name of flags, including their short forms, to the
+// flag.
+func flagsByName(flags []cli.Flag) map[string]cli.Flag {
+	byName := make(map[string]cli.Flag)
+	for _, f := range flags {
+		for _, name := range strings.Split(f.GetName(), ",") {
+			byName[strings.TrimSpace(name)] = f
+		}
+	}
+	return byName
+}
+
+func isBoolFlag(f cli.Flag) bool {
+	switch f.(type) {
+	case cli.BoolFlag, cli.BoolTFlag:
+		return true
+	}
+	return false
+}
+
+// flagDisplayName returns the flag as it is written on the command line.
+func flagDisplayName(name string) string {
+	if len(name) == 1 {
+		return "-" + name
+	}
+	return "--" + name
+}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// applySources applies the sources in order to an empty set of variables.
+func applySources(sources []varSource) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+	for _, source := range sources {
+		err := source.apply(vars)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vars, nil
+}
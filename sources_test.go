@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestParsePrecedence(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected []string
+	}{
+		{"file,env,set", []string{"file", "env", "set"}},
+		{"env, file, set", []string{"env", "file", "set"}},
+		{"set,file,env", []string{"set", "file", "env"}},
+		{"env,file", nil},
+		{"env,file,set,env", nil},
+		{"env,file,file", nil},
+		{"env,file,opt", nil},
+	}
+	for _, tt := range tests {
+		order, err := parsePrecedence(tt.in)
+		if (err != nil) != (tt.expected == nil) || !reflect.DeepEqual(order, tt.expected) {
+			t.Errorf("broken behavior for %q. Expected: %v Got: %v %v", tt.in, tt.expected, order, err)
+		}
+	}
+}
+
+func TestArgSources(t *testing.T) {
+	flags := []cli.Flag{
+		cli.StringSliceFlag{Name: flagSetVarLong},
+		cli.StringSliceFlag{Name: flagVarsFileLong},
+		cli.StringSliceFlag{Name: flagSetJSON},
+		cli.StringFlag{Name: flagOutputLong},
+		cli.BoolFlag{Name: flagInterleave},
+	}
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{
+			[]string{"-s", "a=1", "--interleave", "-f", "one.yaml", "-O", "-s", "--set-json=b=2", "template.tpl"},
+			[]string{"-s a=1", "file one.yaml", "--set-json b=2"},
+		},
+		{
+			[]string{"-f", "one.yaml", "template.tpl", "--vars-file", "two.yaml", "-s", "c=3"},
+			[]string{"file one.yaml"},
+		},
+		{
+			[]string{"-s", "a=1", "--", "-s", "c=3"},
+			[]string{"-s a=1"},
+		},
+	}
+	for _, tt := range tests {
+		var names []string
+		for _, source := range argSources(flags, tt.args, defaultMergeStrategy) {
+			names = append(names, source.name)
+		}
+		if !reflect.DeepEqual(names, tt.expected) {
+			t.Errorf("argSources(%q) broken behavior. Expected: %v Got: %v", tt.args, tt.expected, names)
+		}
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	flags := []cli.Flag{
+		cli.StringSliceFlag{Name: flagVarsFileLong},
+		cli.BoolFlag{Name: flagInterleave},
+	}
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"vars", "-s", "a=1"}, []string{"-s", "a=1"}},
+		{[]string{"-f", "vars", "vars", "-s", "a=1"}, []string{"-s", "a=1"}},
+		{[]string{"--vars-file=vars", "--interleave", "vars", "--explain", "a"}, []string{"--explain", "a"}},
+		{[]string{"--interleave", "template.tpl"}, nil},
+	}
+	for _, tt := range tests {
+		if actual := commandArgs(tt.args, flags, "vars"); !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("commandArgs(%q) broken behavior. Expected: %q Got: %q", tt.args, tt.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+{{- if .name }}
+{{ .name | frobnicate }}
+{{ end }}
+{{ include "header" . }}{{ include "missing" . }}
+{{ .db.host | trimall " " }}
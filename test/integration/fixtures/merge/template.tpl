@@ -0,0 +1,3 @@
+tags={{ join "," .tags }}
+{{ range .containers }}{{ .name }}={{ .image }}
+{{ end }}debug={{ hasKey . "debug" }}
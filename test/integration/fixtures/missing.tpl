@@ -0,0 +1,2 @@
+{{ .FOO }} {{ .BAR }}
+{{ .db.host }}
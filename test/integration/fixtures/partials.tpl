@@ -0,0 +1,3 @@
+{{ include "header" . }}
+body
+{{ template "footer" . }}
@@ -0,0 +1 @@
+{{ define "footer" }}# footer{{ end }}
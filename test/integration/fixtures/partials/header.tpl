@@ -0,0 +1 @@
+{{ define "header" }}# header {{ .FOO }}{{ end }}
@@ -0,0 +1 @@
+{{ define "header" }}# other header{{ end }}
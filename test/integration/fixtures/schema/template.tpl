@@ -0,0 +1 @@
+{{ .name }} {{ .env }} {{ .port }}
@@ -0,0 +1,2 @@
+{{ range .servers }}{{ .host }}:{{ .port }}
+{{ end }}
\ No newline at end of file
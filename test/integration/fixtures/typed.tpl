@@ -0,0 +1 @@
+{{ add .replicas 1 }} {{ if .debug }}on{{ else }}off{{ end }} {{ toJson .cfg }} {{ kindOf .str }}
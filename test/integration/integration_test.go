@@ -1,8 +1,12 @@
 package integration_test
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -22,7 +26,7 @@ var _ = Describe("gucci", func() {
 
 			session := RunWithError(gucciCmd, 1)
 
-			Expect(string(session.Err.Contents())).To(Equal("Failed to parse standard input: template: -:1:8: executing \"-\" at <.FOO>: map has no entry for key \"FOO\"\n"))
+			Expect(string(session.Err.Contents())).To(Equal("Error executing template standard input:1:9: missing variable .FOO\n  1 | text {{ .FOO }} text\n    |         ^\n"))
 		})
 
 		It("loads file", func() {
@@ -30,71 +34,626 @@ var _ = Describe("gucci", func() {
 
 			session := RunWithError(gucciCmd, 1)
 
-			Expect(string(session.Err.Contents())).To(Equal("Failed to parse standard input: template: simple.tpl:1:8: executing \"simple.tpl\" at <.FOO>: map has no entry for key \"FOO\"\n"))
+			Expect(string(session.Err.Contents())).To(Equal("Error executing template " + FixturePath("simple.tpl") + ":1:9: missing variable .FOO\n  1 | text {{ .FOO }} text\n    |         ^\n"))
+		})
+
+	})
+
+	Describe("output destination", func() {
+
+		It("does not write partial output to stdout on failure", func() {
+			gucciCmd := exec.Command(gucciPath, FixturePath("simple.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(session.Out.Contents()).To(BeEmpty())
+			Expect(string(session.Err.Contents())).To(ContainSubstring("missing variable .FOO"))
+		})
+
+		It("writes to the output file", func() {
+			out := filepath.Join(GinkgoT().TempDir(), "nested", "dir", "simple.out")
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				"-O", out,
+				FixturePath("simple.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(session.Out.Contents()).To(BeEmpty())
+			content, err := os.ReadFile(out)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("text bar text\n"))
+			info, err := os.Stat(out)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0644)))
+		})
+
+		It("applies the output file mode", func() {
+			out := filepath.Join(GinkgoT().TempDir(), "simple.out")
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				"--output", out,
+				"--output-mode", "0600",
+				FixturePath("simple.tpl"))
+
+			Run(gucciCmd)
+
+			info, err := os.Stat(out)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("leaves the output file untouched on failure", func() {
+			dir := GinkgoT().TempDir()
+			out := filepath.Join(dir, "simple.out")
+			Expect(os.WriteFile(out, []byte("previous\n"), 0644)).To(Succeed())
+			gucciCmd := exec.Command(gucciPath,
+				"-O", out,
+				FixturePath("simple.tpl"))
+
+			RunWithError(gucciCmd, 1)
+
+			content, err := os.ReadFile(out)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("previous\n"))
+			entries, err := os.ReadDir(dir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+
+	})
+
+	Describe("directory rendering", func() {
+
+		It("mirrors the tree into the output directory", func() {
+			out := GinkgoT().TempDir()
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				"-O", out,
+				FixturePath("tree"))
+
+			Run(gucciCmd)
+
+			content, err := os.ReadFile(filepath.Join(out, "app.conf"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("app=bar\n"))
+			content, err = os.ReadFile(filepath.Join(out, "sub", "nested.conf"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("nested=bar\n"))
+			content, err = os.ReadFile(filepath.Join(out, "sub", "static.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("static {{ .FOO }}\n"))
+		})
+
+		It("uses the template suffix", func() {
+			out := GinkgoT().TempDir()
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				"-O", out,
+				"--template-suffix", ".txt",
+				FixturePath("tree"))
+
+			Run(gucciCmd)
+
+			content, err := os.ReadFile(filepath.Join(out, "sub", "static"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("static bar\n"))
+			content, err = os.ReadFile(filepath.Join(out, "app.conf.tpl"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("app={{ .FOO }}\n"))
+		})
+
+		It("writes nothing when a template fails", func() {
+			out := GinkgoT().TempDir()
+			gucciCmd := exec.Command(gucciPath,
+				"-O", out,
+				FixturePath("tree"))
+
+			RunWithError(gucciCmd, 1)
+
+			entries, err := os.ReadDir(out)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(BeEmpty())
+		})
+
+		It("requires an output directory", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				FixturePath("tree"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("An output directory (--output) is required"))
+		})
+
+	})
+
+	Describe("check mode", func() {
+
+		It("succeeds when the output is up to date", func() {
+			out := filepath.Join(GinkgoT().TempDir(), "simple.out")
+			Expect(os.WriteFile(out, []byte("text bar text\n"), 0644)).To(Succeed())
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				"-O", out,
+				"--check",
+				FixturePath("simple.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(session.Err.Contents()).To(BeEmpty())
+		})
+
+		It("fails with a diff when the output is out of date", func() {
+			out := filepath.Join(GinkgoT().TempDir(), "simple.out")
+			Expect(os.WriteFile(out, []byte("text baz text\n"), 0644)).To(Succeed())
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				"-O", out,
+				"--check",
+				FixturePath("simple.tpl"))
+
+			session := RunWithError(gucciCmd, 2)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("@@ -1 +1 @@\n-text baz text\n+text bar text\n1 file(s)"))
+			Expect(string(session.Err.Contents())).To(ContainSubstring("1 file(s) out of date"))
+			content, err := os.ReadFile(out)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("text baz text\n"))
+		})
+
+		It("keeps the exit code of an out of date output with missing keys", func() {
+			out := filepath.Join(GinkgoT().TempDir(), "missing.out")
+			Expect(os.WriteFile(out, []byte("stale\n"), 0644)).To(Succeed())
+			gucciCmd := exec.Command(gucciPath,
+				"-o", "missingkey=report",
+				"-f", FixturePath("simple_vars.yaml"),
+				"-O", out,
+				"--check",
+				FixturePath("missing.tpl"))
+
+			session := RunWithError(gucciCmd, 2)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("-stale\n+bar \n+\n"))
+			Expect(string(session.Err.Contents())).To(HaveSuffix("2 missing variable(s):\n  " + FixturePath("missing.tpl") + ":1:15: .BAR\n  " + FixturePath("missing.tpl") + ":2:7: .db.host\n1 file(s) out of date\n"))
+		})
+
+		It("reports missing files in a directory", func() {
+			out := GinkgoT().TempDir()
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				"-O", out,
+				"--check",
+				FixturePath("tree"))
+
+			session := RunWithError(gucciCmd, 2)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("--- /dev/null"))
+			entries, err := os.ReadDir(out)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(BeEmpty())
+		})
+
+	})
+
+	Describe("partials", func() {
+
+		It("loads partials from a directory", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				"-p", FixturePath("partials"),
+				FixturePath("partials.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("# header bar\nbody\n# footer\n"))
+		})
+
+		It("loads partials from globs", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				"-p", FixturePath("partials/head*.tpl"),
+				"-p", FixturePath("partials/foot*.tpl"),
+				FixturePath("partials.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("# header bar\nbody\n# footer\n"))
+		})
+
+		It("rejects duplicate definitions", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				"-p", FixturePath("partials"),
+				"-p", FixturePath("partials_dup"),
+				FixturePath("partials.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("template \"header\" is defined in both"))
+		})
+
+		It("rejects globs without matches", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-p", FixturePath("partials/*.missing"),
+				FixturePath("partials.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("No partials found matching"))
 		})
 
 	})
 
 	Describe("variable source", func() {
 
-		It("reads env vars", func() {
-			gucciCmd := exec.Command(gucciPath, FixturePath("simple.tpl"))
+		It("reads env vars", func() {
+			gucciCmd := exec.Command(gucciPath, FixturePath("simple.tpl"))
+			gucciCmd.Env = []string{
+				"FOO=bar",
+			}
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
+		})
+
+		It("takes env vars literally", func() {
+			gucciCmd := exec.Command(gucciPath, "-s", "FOO=bar", "--precedence", "set,env,file", FixturePath("simple.tpl"))
+			gucciCmd.Env = []string{
+				"FOO=~delete",
+			}
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("text ~delete text\n"))
+		})
+
+		It("loads vars file", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-f", FixturePath("simple_vars.yaml"),
+				FixturePath("simple.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
+		})
+
+		It("loads toml vars file", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-f", FixturePath("simple_vars.toml"),
+				FixturePath("simple.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
+		})
+
+		It("loads dotenv vars file", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-f", FixturePath("simple_vars.env"),
+				FixturePath("simple.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
+		})
+
+		It("reads vars from stdin", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-f", "-",
+				FixturePath("simple.tpl"))
+			gucciCmd.Stdin = strings.NewReader(`{"FOO": "bar"}`)
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
+		})
+
+		It("reads vars from stdin with an explicit format", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-f", "env:-",
+				FixturePath("simple.tpl"))
+			gucciCmd.Stdin = strings.NewReader("FOO=bar\n")
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
+		})
+
+		It("refuses to read vars and template from stdin", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-f", "-")
+			gucciCmd.Stdin = strings.NewReader(`{"FOO": "bar"}`)
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("Cannot read both the template and variables from standard input"))
+		})
+
+		It("loads multiple vars files", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-f", FixturePath("precedence_vars.yaml"),
+				"-f", FixturePath("simple_vars.yaml"),
+				FixturePath("simple.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
+		})
+
+		It("uses vars options", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FOO=bar",
+				FixturePath("simple.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
+		})
+	})
+
+	Describe("typed variable options", func() {
+
+		It("converts values set with --set", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--set", "replicas=3",
+				"--set", "debug=false",
+				"--set-json", `cfg={"list":[1,"a"]}`,
+				"--set-string", "str=42",
+				FixturePath("typed.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("4 off {\"list\":[1,\"a\"]} string\n"))
+		})
+
+		It("keeps values set with --set-var as strings", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--set", "replicas=3",
+				"--set", "debug=true",
+				"--set-json", `cfg=null`,
+				"-s", "str=42",
+				FixturePath("typed.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("4 on null string\n"))
+		})
+
+		It("rejects invalid JSON", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--set-json", `cfg={"list"`,
+				FixturePath("typed.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("Invalid value for --set-json cfg"))
+		})
+
+		It("applies options of different kinds in the order given", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--set", "x=1",
+				"--set-json", "x=2",
+				"--set-string", "y=1",
+				"-s", "y=2",
+				"--set-json", `z={"a":1}`,
+				"--set-string", "z.a=3")
+			gucciCmd.Stdin = strings.NewReader("{{ .x }} {{ .y }} {{ .z.a }}")
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("2 2 3"))
+		})
+
+	})
+
+	Describe("file variable options", func() {
+
+		It("sets the verbatim file content", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--set-file", "tls.cert="+FixturePath("content.txt"))
+			gucciCmd.Stdin = strings.NewReader(`[{{ .tls.cert }}]`)
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("[line1\nline2\n\n]"))
+		})
+
+		It("sets the base64 encoded file content", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--set-file-base64", "files[0]="+FixturePath("content.txt"))
+			gucciCmd.Stdin = strings.NewReader(`{{ index .files 0 | b64dec }}`)
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("line1\nline2\n\n"))
+		})
+
+		It("fails when the file is missing", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--set-file", "cert="+FixturePath("missing.txt"))
+			gucciCmd.Stdin = strings.NewReader(`{{ .cert }}`)
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("Invalid value for --set-file cert"))
+		})
+
+	})
+
+	Describe("variable precedence", func() {
+
+		It("should override variables sources", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "C=from_opt",
+				"-f", FixturePath("precedence_vars.yaml"),
+				FixturePath("precedence.tpl"))
+			gucciCmd.Env = []string{
+				"B=from_env",
+				"C=from_env",
+			}
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("A=from_file\nB=from_env\nC=from_opt\n"))
+		})
+
+	})
+
+	Describe("configurable precedence", func() {
+
+		It("should follow the given precedence", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--precedence", "env,file,set",
+				"-s", "C=from_opt",
+				"-f", FixturePath("precedence_vars.yaml"),
+				FixturePath("precedence.tpl"))
+			gucciCmd.Env = []string{
+				"B=from_env",
+				"C=from_env",
+			}
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("A=from_file\nB=from_file\nC=from_opt\n"))
+		})
+
+		It("should interleave files and options in command line order", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--interleave",
+				"-s", "A=from_opt",
+				"-f", FixturePath("precedence_vars.yaml"),
+				"-s", "B=from_opt",
+				FixturePath("precedence.tpl"))
+			gucciCmd.Env = []string{
+				"C=from_env",
+			}
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("A=from_file\nB=from_opt\nC=from_file\n"))
+		})
+
+		It("should show the resolved order in verbose output", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--verbose",
+				"--precedence", "set,env,file",
+				"-s", "C=from_opt",
+				"-f", FixturePath("precedence_vars.yaml"),
+				FixturePath("precedence.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Err.Contents())).To(Equal("Variable sources, from lowest to highest precedence:\n" +
+				"  -s C=from_opt\n" +
+				"  environment\n" +
+				"  file " + FixturePath("precedence_vars.yaml") + "\n"))
+		})
+
+		It("should reject an invalid precedence", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--precedence", "env,file",
+				FixturePath("precedence.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("invalid precedence \"env,file\""))
+		})
+
+	})
+
+	Describe("environment variables", func() {
+
+		It("should namespace environment variables", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--env-mode", "namespaced")
 			gucciCmd.Env = []string{
 				"FOO=bar",
 			}
+			gucciCmd.Stdin = strings.NewReader(`{{ .Env.FOO }} {{ hasKey . "FOO" }}`)
 
 			session := Run(gucciCmd)
 
-			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
+			Expect(string(session.Out.Contents())).To(Equal("bar false"))
 		})
 
-		It("loads vars file", func() {
+		It("should ignore environment variables", func() {
 			gucciCmd := exec.Command(gucciPath,
-				"-f", FixturePath("simple_vars.yaml"),
-				FixturePath("simple.tpl"))
+				"--env-mode", "none")
+			gucciCmd.Env = []string{
+				"FOO=bar",
+			}
+			gucciCmd.Stdin = strings.NewReader(`{{ len . }}`)
 
 			session := Run(gucciCmd)
 
-			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
+			Expect(string(session.Out.Contents())).To(Equal("0"))
 		})
 
-		It("loads multiple vars files", func() {
+		It("should only import prefixed environment variables", func() {
 			gucciCmd := exec.Command(gucciPath,
-				"-f", FixturePath("precedence_vars.yaml"),
-				"-f", FixturePath("simple_vars.yaml"),
-				FixturePath("simple.tpl"))
+				"--env-prefix", "APP_")
+			gucciCmd.Env = []string{
+				"APP_FOO=bar",
+				"FOO=other",
+			}
+			gucciCmd.Stdin = strings.NewReader(`{{ .FOO }} {{ len . }}`)
 
 			session := Run(gucciCmd)
 
-			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
+			Expect(string(session.Out.Contents())).To(Equal("bar 1"))
 		})
 
-		It("uses vars options", func() {
+		It("should nest environment variables on a separator", func() {
 			gucciCmd := exec.Command(gucciPath,
-				"-s", "FOO=bar",
+				"--env-prefix", "APP__",
+				"--env-separator", "__",
+				"-f", FixturePath("nesting_vars.yaml"),
+				FixturePath("nesting.tpl"))
+			gucciCmd.Env = []string{
+				"APP__foo__bar__baz=from_env",
+			}
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("from_env\n"))
+		})
+
+		It("should resolve _FILE environment variables", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--env-files",
 				FixturePath("simple.tpl"))
+			gucciCmd.Env = []string{
+				"FOO_FILE=" + FixturePath("secret.txt"),
+			}
 
 			session := Run(gucciCmd)
 
 			Expect(string(session.Out.Contents())).To(Equal("text bar text\n"))
 		})
-	})
-
-	Describe("variable precedence", func() {
 
-		It("should override variables sources", func() {
+		It("should fail when a _FILE environment variable points to a missing file", func() {
 			gucciCmd := exec.Command(gucciPath,
-				"-s", "C=from_opt",
-				"-f", FixturePath("precedence_vars.yaml"),
-				FixturePath("precedence.tpl"))
+				"--env-files",
+				FixturePath("simple.tpl"))
 			gucciCmd.Env = []string{
-				"B=from_env",
-				"C=from_env",
+				"FOO_FILE=" + FixturePath("missing.txt"),
 			}
 
-			session := Run(gucciCmd)
+			session := RunWithError(gucciCmd, 1)
 
-			Expect(string(session.Out.Contents())).To(Equal("A=from_file\nB=from_env\nC=from_opt\n"))
+			Expect(string(session.Err.Contents())).To(ContainSubstring("Error reading FOO from FOO_FILE"))
+		})
+
+		It("should reject an invalid mode", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--env-mode", "flat",
+				FixturePath("simple.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("invalid env mode \"flat\""))
 		})
 
 	})
@@ -121,6 +680,68 @@ var _ = Describe("gucci", func() {
 			Expect(string(session.Out.Contents())).To(Equal("yep\n"))
 		})
 
+		It("should set list elements from a vars file", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-f", FixturePath("servers_vars.yaml"),
+				"-s", "servers[1].port=9000",
+				"-s", "servers[2].host=c",
+				"-s", "servers[2].port=3",
+				FixturePath("servers.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("a:1\nb:9000\nc:3\n"))
+		})
+
+		It("should support escaped dots in option keys", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-s", `foo.bar\.baz=yep`,
+				"-s", `foo."bar.qux"=yes`)
+			gucciCmd.Stdin = strings.NewReader(`{{ index .foo "bar.baz" }} {{ index .foo "bar.qux" }}`)
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("yep yes"))
+		})
+
+	})
+
+	Describe("merge strategies", func() {
+
+		It("replaces lists and applies directives by default", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-f", FixturePath("merge/base.yaml"),
+				"-f", FixturePath("merge/overlay.yaml"),
+				FixturePath("merge/template.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("tags=overlay\nweb=web:2\nsidecar=proxy:1\ndebug=false\n"))
+		})
+
+		It("appends lists", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--merge-strategy", "append",
+				"-f", FixturePath("merge/base.yaml"),
+				"-f", FixturePath("merge/overlay.yaml"),
+				FixturePath("merge/template.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("tags=base,overlay\nweb=web:2\nsidecar=proxy:1\ndebug=false\n"))
+		})
+
+		It("rejects unknown strategies", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--merge-strategy", "prepend",
+				"-f", FixturePath("merge/base.yaml"),
+				FixturePath("merge/template.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(ContainSubstring("invalid merge strategy \"prepend\""))
+		})
+
 	})
 
 	Describe("toJson and mustToJson functions", func() {
@@ -187,4 +808,370 @@ var _ = Describe("gucci", func() {
 		})
 	})
 
+	Describe("vars command", func() {
+		It("prints the merged variables as yaml", func() {
+			gucciCmd := exec.Command(gucciPath, "vars",
+				"--env-mode", "none",
+				"-f", FixturePath("merge/base.yaml"),
+				"-f", FixturePath("merge/overlay.yaml"),
+				"-s", "tags[0]=set")
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal(`containers:
+- image: web:2
+  name: web
+- image: proxy:1
+  name: sidecar
+tags:
+- set
+`))
+		})
+
+		It("prints the merged variables as json", func() {
+			gucciCmd := exec.Command(gucciPath, "vars",
+				"--env-mode", "none",
+				"--format", "json",
+				"-f", FixturePath("simple_vars.toml"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("{\n  \"FOO\": \"bar\"\n}\n"))
+		})
+
+		It("uses the variable flags given before the command", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--env-mode", "none",
+				"--interleave",
+				"-s", "tags[0]=global",
+				"-f", FixturePath("merge/base.yaml"),
+				"vars",
+				"-s", "containers[1].image=proxy:2")
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal(`containers:
+- image: web:1
+  name: web
+- image: proxy:2
+  name: sidecar
+debug: true
+tags:
+- base
+`))
+		})
+
+		It("explains which sources set a key", func() {
+			gucciCmd := exec.Command(gucciPath, "vars",
+				"-f", FixturePath("merge/base.yaml"),
+				"-f", FixturePath("merge/overlay.yaml"),
+				"--set", "containers[0].image=web:3",
+				"--explain", "containers[0].image")
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal(`Sources setting containers[0].image, from lowest to highest precedence:
+  file ` + FixturePath("merge/base.yaml") + `:6: "web:1"
+  file ` + FixturePath("merge/overlay.yaml") + `:8: "web:2"
+  --set containers[0].image=web:3: "web:3"
+Value: "web:3"
+`))
+		})
+
+		It("explains deleted keys", func() {
+			gucciCmd := exec.Command(gucciPath, "vars",
+				"-f", FixturePath("merge/base.yaml"),
+				"-f", FixturePath("merge/overlay.yaml"),
+				"--explain", "debug")
+
+			session := Run(gucciCmd)
+
+			output := string(session.Out.Contents())
+			Expect(output).To(ContainSubstring("overlay.yaml:9: deleted"))
+			Expect(output).To(ContainSubstring("Value: not set"))
+		})
+	})
+
+	Describe("missing key report", func() {
+		It("reports every missing key and writes nothing", func() {
+			out := filepath.Join(GinkgoT().TempDir(), "missing.out")
+			gucciCmd := exec.Command(gucciPath,
+				"-o", "missingkey=report",
+				"-f", FixturePath("simple_vars.yaml"),
+				"-O", out,
+				FixturePath("missing.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(out).NotTo(BeAnExistingFile())
+			Expect(string(session.Err.Contents())).To(Equal(fmt.Sprintf("2 missing variable(s):\n  %[1]s:1:15: .BAR\n  %[1]s:2:7: .db.host\n", FixturePath("missing.tpl"))))
+		})
+
+		It("reports keys missing within range", func() {
+			gucciCmd := exec.Command(gucciPath, "-o", "missingkey=report", "--set-json", `xs=[{"a":1},{"a":2}]`)
+			gucciCmd.Stdin = strings.NewReader("{{ range .xs }}{{ .a }}{{ .missing }} {{ end }}")
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Out.Contents())).To(BeEmpty())
+			Expect(string(session.Err.Contents())).To(Equal("1 missing variable(s):\n  -:1:27: .xs[].missing\n"))
+		})
+
+		It("renders missing keys as zero values", func() {
+			out := filepath.Join(GinkgoT().TempDir(), "missing.out")
+			Expect(os.WriteFile(out, []byte("bar \n\n"), 0644)).To(Succeed())
+			gucciCmd := exec.Command(gucciPath,
+				"-o", "missingkey=report",
+				"-f", FixturePath("simple_vars.yaml"),
+				"--check", "-O", out,
+				FixturePath("missing.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(HavePrefix("2 missing variable(s):\n"))
+		})
+	})
+
+	Describe("error diagnostics", func() {
+		It("suggests the closest variable", func() {
+			gucciCmd := exec.Command(gucciPath, "-s", "FOO=bar")
+			gucciCmd.Stdin = strings.NewReader("a\n{{ .FOOO }}")
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(Equal("Error executing template standard input:2:4: missing variable .FOOO\n  2 | {{ .FOOO }}\n    |    ^\nDid you mean .FOO?\n"))
+		})
+
+		It("points at the partial the error occurred in", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"-s", "FO=bar",
+				"-p", FixturePath("partials"),
+				FixturePath("partials.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(Equal("Error executing template " + FixturePath("partials/header.tpl") + ":1:34: missing variable .FOO\n" +
+				"  1 | {{ define \"header\" }}# header {{ .FOO }}{{ end }}\n" +
+				"    |                                  ^\n" +
+				"Did you mean .FO?\n"))
+		})
+
+		It("points at parse errors", func() {
+			gucciCmd := exec.Command(gucciPath)
+			gucciCmd.Stdin = strings.NewReader("a\n{{ if }}")
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(Equal("Error parsing template standard input:2: missing value for if\n  2 | {{ if }}\n"))
+		})
+	})
+
+	Describe("JSON errors", func() {
+		It("prints execution errors", func() {
+			gucciCmd := exec.Command(gucciPath, "--error-format", "json", FixturePath("simple.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(Equal(`{"kind":"exec","file":"` + FixturePath("simple.tpl") + `","line":1,"column":9,"key":".FOO","message":"missing variable .FOO","exit_code":1}` + "\n"))
+		})
+
+		It("prints variables file errors", func() {
+			vars := filepath.Join(GinkgoT().TempDir(), "vars.yaml")
+			Expect(os.WriteFile(vars, []byte("a: 1\nb: [\n"), 0644)).To(Succeed())
+			gucciCmd := exec.Command(gucciPath, "--error-format", "json", "-f", vars, FixturePath("simple.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			var e map[string]interface{}
+			Expect(json.Unmarshal(session.Err.Contents(), &e)).To(Succeed())
+			Expect(e).To(Equal(map[string]interface{}{
+				"kind":      "vars",
+				"file":      vars,
+				"line":      2.0,
+				"message":   "yaml: line 2: did not find expected node content",
+				"exit_code": 1.0,
+			}))
+		})
+
+		It("prints shell errors", func() {
+			gucciCmd := exec.Command(gucciPath, "--error-format", "json")
+			gucciCmd.Stdin = strings.NewReader(`{{ shell "exit 3" }}`)
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(Equal(`{"kind":"shell","file":"-","line":1,"column":4,"function":"shell","message":"error calling shell: Issue running command: : exit status 3","exit_code":1}` + "\n"))
+		})
+
+		It("prints the exit code of --check", func() {
+			out := filepath.Join(GinkgoT().TempDir(), "simple.out")
+			Expect(os.WriteFile(out, []byte("stale"), 0644)).To(Succeed())
+			gucciCmd := exec.Command(gucciPath, "--error-format", "json", "--check", "-s", "FOO=bar", "-O", out, FixturePath("simple.tpl"))
+
+			session := RunWithError(gucciCmd, 2)
+
+			Expect(string(session.Err.Contents())).To(HaveSuffix(`{"kind":"output","message":"1 file(s) out of date","exit_code":2}` + "\n"))
+		})
+
+		It("prints the errors of commands", func() {
+			vars := filepath.Join(GinkgoT().TempDir(), "vars.json")
+			Expect(os.WriteFile(vars, []byte(`{"a": `), 0644)).To(Succeed())
+			gucciCmd := exec.Command(gucciPath, "--error-format", "json", "vars", "-f", vars)
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(Equal(`{"kind":"vars","file":"` + vars + `","line":1,"column":6,"message":"unexpected end of JSON input","exit_code":1}` + "\n"))
+		})
+
+		It("prints the usage errors of commands", func() {
+			gucciCmd := exec.Command(gucciPath, "--error-format", "json", "lint")
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(Equal(`{"kind":"usage","message":"At least one template to lint is required","exit_code":1}` + "\n"))
+		})
+
+		It("prints usage errors found while rendering", func() {
+			gucciCmd := exec.Command(gucciPath, "--error-format", "json", "--check", "-s", "FOO=bar", FixturePath("simple.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(Equal(`{"kind":"usage","message":"--check requires an output path (--output) to compare against","exit_code":1}` + "\n"))
+		})
+
+		It("prints the path of missing keys", func() {
+			gucciCmd := exec.Command(gucciPath, "--error-format", "json", "-o", "missingkey=report", "-f", FixturePath("simple_vars.yaml"), FixturePath("missing.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Err.Contents())).To(HavePrefix(`{"kind":"exec","file":"` + FixturePath("missing.tpl") + `","line":1,"column":15,"key":".BAR"`))
+		})
+	})
+
+	Describe("analyze command", func() {
+		It("lists the fields referenced, following partials", func() {
+			gucciCmd := exec.Command(gucciPath, "analyze",
+				"-p", FixturePath("partials"),
+				FixturePath("partials.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("Fields:\n  .FOO\nFunctions:\n  include\nShell: no\n"))
+		})
+
+		It("prints json", func() {
+			gucciCmd := exec.Command(gucciPath, "analyze", "--format", "json", FixturePath("servers.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(MatchJSON(`{
+				"fields": [".servers", ".servers[].host", ".servers[].port"],
+				"functions": [],
+				"shell": false
+			}`))
+		})
+	})
+
+	Describe("init-vars command", func() {
+		It("generates a skeleton vars file", func() {
+			gucciCmd := exec.Command(gucciPath, "init-vars", FixturePath("servers.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("servers:\n- host: TODO\n  port: TODO\n"))
+		})
+
+		It("generates vars the template renders with", func() {
+			vars := filepath.Join(GinkgoT().TempDir(), "vars.json")
+			gucciCmd := exec.Command(gucciPath, "init-vars", "--format", "json", FixturePath("nesting.tpl"))
+
+			session := Run(gucciCmd)
+			Expect(os.WriteFile(vars, session.Out.Contents(), 0644)).To(Succeed())
+
+			gucciCmd = exec.Command(gucciPath, "-f", vars, FixturePath("nesting.tpl"))
+
+			session = Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("TODO\n"))
+		})
+	})
+
+	Describe("schema validation", func() {
+		It("reports every violation before rendering", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--schema", FixturePath("schema/values.schema.json"),
+				"-s", "env=qa",
+				"--set", "port=0",
+				FixturePath("schema/template.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(session.Out.Contents()).To(BeEmpty())
+			Expect(string(session.Err.Contents())).To(Equal("Variables do not match the schema " + FixturePath("schema/values.schema.json") + ":\n" +
+				"  '': missing properties: 'name'\n" +
+				"  '/env': value must be one of \"dev\", \"prod\"\n" +
+				"  '/port': must be >= 1 but found 0\n"))
+		})
+
+		It("applies schema defaults", func() {
+			gucciCmd := exec.Command(gucciPath,
+				"--schema", FixturePath("schema/values.schema.json"),
+				"--schema-defaults",
+				"-s", "name=app",
+				FixturePath("schema/template.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(Equal("app dev 8080\n"))
+		})
+	})
+
+	Describe("lint command", func() {
+		It("reports problems in templates", func() {
+			tpl := FixturePath("lint/template.tpl")
+			gucciCmd := exec.Command(gucciPath, "lint",
+				"-p", FixturePath("partials"),
+				"-f", FixturePath("lint/vars.yaml"),
+				tpl)
+
+			session := RunWithError(gucciCmd, 1)
+
+			Expect(string(session.Out.Contents())).To(Equal(
+				tpl + ":2:12: error: function \"frobnicate\" is not defined [unknown-function]\n" +
+					tpl + ":3:1: warning: {{ end }} trims whitespace differently from {{- if }} at line 1 [unbalanced-trim]\n" +
+					tpl + ":4:28: error: template \"missing\" is not defined [undefined-template]\n" +
+					tpl + ":5:7: warning: .db.host is not set by the variables files [missing-key]\n" +
+					tpl + ":5:15: warning: function \"trimall\" is deprecated, use \"trimAll\" instead [deprecated-function]\n" +
+					FixturePath("partials/header.tpl") + ":1:34: warning: .FOO is not set by the variables files [missing-key]\n"))
+		})
+
+		It("succeeds with only warnings", func() {
+			gucciCmd := exec.Command(gucciPath, "lint", "--format", "json", FixturePath("partials/header.tpl"))
+
+			session := Run(gucciCmd)
+
+			Expect(string(session.Out.Contents())).To(MatchJSON("[]"))
+		})
+
+		It("prints sarif", func() {
+			gucciCmd := exec.Command(gucciPath, "lint", "--format", "sarif", FixturePath("lint/template.tpl"))
+
+			session := RunWithError(gucciCmd, 1)
+
+			var log struct {
+				Version string
+				Runs    []struct {
+					Results []struct {
+						RuleID string
+						Level  string
+					}
+				}
+			}
+			Expect(json.Unmarshal(session.Out.Contents(), &log)).To(Succeed())
+			Expect(log.Version).To(Equal("2.1.0"))
+			Expect(log.Runs).To(HaveLen(1))
+			Expect(log.Runs[0].Results[0].RuleID).To(Equal("unknown-function"))
+			Expect(log.Runs[0].Results[0].Level).To(Equal("error"))
+		})
+	})
+
 })
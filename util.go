@@ -1,15 +1,20 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"text/template/parse"
 
+	"github.com/BurntSushi/toml"
 	"gopkg.in/yaml.v2"
 )
 
@@ -22,6 +27,142 @@ func env() map[string]interface{} {
 	return env
 }
 
+const (
+	envModeRoot       = "root"
+	envModeNamespaced = "namespaced"
+	envModeNone       = "none"
+
+	// envNamespace is the key environment variables are exposed under in
+	// namespaced mode.
+	envNamespace = "Env"
+)
+
+// envOptions controls which environment variables are exposed to templates
+// and where.
+type envOptions struct {
+	mode      string
+	prefix    string
+	separator string
+
+	// resolveFiles enables reading X from the file named by X_FILE, limited
+	// to the names in filesAllow, if any, and excluding those in filesDeny.
+	resolveFiles bool
+	filesAllow   []string
+	filesDeny    []string
+}
+
+func parseEnvMode(mode string) (string, error) {
+	switch mode {
+	case envModeRoot, envModeNamespaced, envModeNone:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid env mode %q: must be %s, %s or %s", mode, envModeRoot, envModeNamespaced, envModeNone)
+}
+
+// envVars returns the environment variables selected by opts. With a prefix,
+// only variables starting with it are included, with the prefix stripped.
+// X_FILE variables are then resolved among those, by their stripped names.
+// With a separator, variable names are split on it into nested maps, so that
+// DB__HOST becomes .DB.HOST with the separator "__".
+func envVars(opts envOptions) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+	if opts.mode == envModeNone {
+		return vars, nil
+	}
+
+	environ := make(map[string]interface{})
+	for key, val := range env() {
+		if opts.prefix != "" {
+			if !strings.HasPrefix(key, opts.prefix) || key == opts.prefix {
+				continue
+			}
+			key = strings.TrimPrefix(key, opts.prefix)
+		}
+		environ[key] = val
+	}
+	if opts.resolveFiles {
+		err := resolveFileEnv(environ, opts.filesAllow, opts.filesDeny)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]string, 0, len(environ))
+	for key := range environ {
+		keys = append(keys, key)
+	}
+	// Sorted so that nesting conflicts, like DB and DB__HOST, resolve the
+	// same way every time.
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		val := environ[key]
+		if opts.separator != "" {
+			key = strings.TrimPrefix(key, opts.separator)
+			if strings.Contains(key, opts.separator) && !hasEmptyPart(key, opts.separator) {
+				err := mergeVars(vars, splitKeyValToMap(key, opts.separator, val), defaultMergeStrategy)
+				if err != nil {
+					return nil, fmt.Errorf("Error merging environment variable %s: %v", key, err)
+				}
+				continue
+			}
+		}
+		vars[key] = val
+	}
+
+	if opts.mode == envModeNamespaced {
+		return map[string]interface{}{envNamespace: vars}, nil
+	}
+	return vars, nil
+}
+
+// resolveFileEnv sets X to the content of the file named by X_FILE, for every
+// X_FILE variable in environ, as is common for Docker secrets. A single
+// trailing newline is removed from the content. The allow and deny lists hold
+// variable names, with or without the _FILE suffix.
+func resolveFileEnv(environ map[string]interface{}, allow, deny []string) error {
+	listed := func(list []string, name, key string) bool {
+		return indexOf(list, name) >= 0 || indexOf(list, key) >= 0
+	}
+
+	keys := make([]string, 0, len(environ))
+	for key := range environ {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := strings.TrimSuffix(key, "_FILE")
+		if name == key || name == "" {
+			continue
+		}
+		if (len(allow) > 0 && !listed(allow, name, key)) || listed(deny, name, key) {
+			continue
+		}
+		if _, ok := environ[name]; ok {
+			return fmt.Errorf("Both %s and %s are set in the environment, only one may be used", name, key)
+		}
+
+		path := environ[key].(string)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Error reading %s from %s: %v", name, key, err)
+		}
+		val := strings.TrimSuffix(string(content), "\n")
+		environ[name] = strings.TrimSuffix(val, "\r")
+	}
+	return nil
+}
+
+func hasEmptyPart(key, sep string) bool {
+	for _, part := range strings.Split(key, sep) {
+		if part == "" {
+			return true
+		}
+	}
+	return false
+}
+
 func getKeyVal(item string) (key, val string) {
 	splits := strings.Split(item, "=")
 	key = splits[0]
@@ -34,80 +175,295 @@ func loadTemplateFile(tplFile string) (*template.Template, error) {
 	tpl := template.New(tplName)
 	_, err := tpl.Funcs(getFuncMap(tpl)).ParseFiles(tplFile)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing template(s): %v", err)
+		return nil, newParseDiagnostic(err, templateSource{path: tplFile})
 	}
 	return tpl, nil
 }
 
-func loadTemplateStream(name string, in io.Reader) (*template.Template, error) {
-	tplBytes, err := ioutil.ReadAll(in)
-	if err != nil {
-		return nil, fmt.Errorf("Error reading template(s): %v", err)
-	}
-	tplStr := string(tplBytes)
-	return loadTemplateString(name, tplStr)
-}
-
 func loadTemplateString(name, s string) (*template.Template, error) {
 	tpl := template.New(name)
 	tpl, err := tpl.Funcs(getFuncMap(tpl)).Parse(s)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing template(s): %v", err)
+		return nil, newParseDiagnostic(err, templateSource{path: name, text: s})
 	}
 	return tpl, nil
 }
 
 func loadTemplateFileOrStdin(f string) (*template.Template, error) {
-	var tpl *template.Template
-	if f == "" {
-		t, err := loadTemplateStream("-", os.Stdin)
+	tpl, _, err := loadTemplateSource(f)
+	return tpl, err
+}
+
+// loadTemplateSource loads the template at f, or standard input when f is
+// empty, along with where its content can be found again for diagnostics.
+func loadTemplateSource(f string) (*template.Template, templateSource, error) {
+	if f != "" {
+		tpl, err := loadTemplateFile(f)
+		return tpl, templateSource{path: f}, err
+	}
+	tplBytes, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, templateSource{}, withKind(diagnosticParse, fmt.Errorf("Error reading template(s): %v", err))
+	}
+	src := templateSource{path: "-", text: string(tplBytes)}
+	tpl, err := loadTemplateString("-", src.text)
+	return tpl, src, err
+}
+
+// findPartials expands each pattern, either a directory whose files are all
+// used or a glob, into the list of partial template files.
+func findPartials(patterns []string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		if isDir(pattern) {
+			entries, err := os.ReadDir(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading partials: %v", err)
+			}
+			for _, e := range entries {
+				if !e.IsDir() {
+					files = append(files, filepath.Join(pattern, e.Name()))
+				}
+			}
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Error reading partials: %v", err)
 		}
-		tpl = t
-	} else {
-		t, err := loadTemplateFile(f)
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("No partials found matching %s", pattern)
+		}
+		for _, m := range matches {
+			if !isDir(m) {
+				files = append(files, m)
+			}
+		}
+	}
+	return files, nil
+}
+
+// loadPartials parses the given files into the template set of tpl, making
+// the templates they define available to template and include. Defining the
+// same template more than once is an error.
+func loadPartials(tpl *template.Template, files []string) error {
+	defined := make(map[string]string)
+	for _, t := range tpl.Templates() {
+		if isDefinition(t, tpl.Name()) {
+			defined[t.Name()] = tpl.Name()
+		}
+	}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
 		if err != nil {
-			return nil, err
+			return withKind(diagnosticParse, fmt.Errorf("Error reading partial: %v", err))
+		}
+		name := filepath.Base(file)
+		partial, err := template.New(name).Funcs(getFuncMap(tpl)).Parse(string(content))
+		if err != nil {
+			return newParseDiagnostic(err, templateSource{path: file, text: string(content)})
+		}
+
+		for _, t := range partial.Templates() {
+			if !isDefinition(t, name) {
+				continue
+			}
+			if origin, ok := defined[t.Name()]; ok {
+				return &diagnostic{
+					kind:    diagnosticParse,
+					file:    file,
+					message: fmt.Sprintf("template %q is defined in both %s and %s", t.Name(), origin, file),
+				}
+			}
+			defined[t.Name()] = file
+			if _, err := tpl.AddParseTree(t.Name(), t.Tree); err != nil {
+				return &diagnostic{kind: diagnosticParse, file: file, message: err.Error()}
+			}
 		}
-		tpl = t
+	}
+	return nil
+}
+
+// loadTemplateWithPartials loads the template at tplPath, or standard input
+// when tplPath is empty, along with the partials matching patterns.
+func loadTemplateWithPartials(tplPath string, patterns []string) (*template.Template, error) {
+	tpl, err := loadTemplateFileOrStdin(tplPath)
+	if err != nil {
+		return nil, err
+	}
+	partials, err := findPartials(patterns)
+	if err != nil {
+		return nil, err
+	}
+	err = loadPartials(tpl, partials)
+	if err != nil {
+		return nil, err
 	}
 	return tpl, nil
 }
 
+// isDefinition reports whether t holds template content, ignoring the root
+// template of a file when it merely consists of definitions.
+func isDefinition(t *template.Template, rootName string) bool {
+	if t.Tree == nil {
+		return false
+	}
+	return t.Name() != rootName || !parse.IsEmptyTree(t.Tree.Root)
+}
+
+func isDir(path string) bool {
+	if path == "" {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// sameFile reports whether a and b refer to the same existing file.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
+
 func isJsonFile(path string) bool {
 	path = strings.ToLower(path)
-	return strings.HasSuffix(path, "json")
+	return strings.HasSuffix(path, ".json")
 }
 
 func isYamlFile(path string) bool {
 	path = strings.ToLower(path)
-	return strings.HasSuffix(path, "yaml") ||
-		strings.HasSuffix(path, "yml")
+	return strings.HasSuffix(path, ".yaml") ||
+		strings.HasSuffix(path, ".yml")
 }
 
-func loadVarsFile(path string) (map[string]interface{}, error) {
-	var result map[string]interface{}
-	var err error
+func isTomlFile(path string) bool {
+	path = strings.ToLower(path)
+	return strings.HasSuffix(path, ".toml")
+}
 
-	content, err := ioutil.ReadFile(path)
+func isDotenvFile(path string) bool {
+	base := strings.ToLower(filepath.Base(path))
+	return base == ".env" ||
+		strings.HasPrefix(base, ".env.") ||
+		strings.HasSuffix(base, ".env")
+}
+
+// varsParsers maps the formats that may be given in a FORMAT:PATH variables
+// file argument to their parsers.
+var varsParsers = map[string]func([]byte) (map[string]interface{}, error){
+	"json":   unmarshalJsonFile,
+	"yaml":   unmarshalYamlFile,
+	"yml":    unmarshalYamlFile,
+	"toml":   unmarshalTomlFile,
+	"env":    unmarshalDotenvFile,
+	"dotenv": unmarshalDotenvFile,
+}
+
+// splitVarsFileArg splits an optional FORMAT: prefix, such as the "yaml" in
+// "yaml:/dev/fd/63", from a variables file argument.
+func splitVarsFileArg(arg string) (format, path string) {
+	if i := strings.Index(arg, ":"); i > 0 {
+		format := strings.ToLower(arg[:i])
+		if _, ok := varsParsers[format]; ok {
+			return format, arg[i+1:]
+		}
+	}
+	return "", arg
+}
+
+// varsFileFormat returns the format of a variables file based on its
+// extension, or an empty string when it is not recognized.
+func varsFileFormat(path string) string {
+	switch {
+	case isJsonFile(path):
+		return "json"
+	case isYamlFile(path):
+		return "yaml"
+	case isTomlFile(path):
+		return "toml"
+	case isDotenvFile(path):
+		return "env"
+	}
+	return ""
+}
+
+// varsFile is the raw content of a variables file.
+type varsFile struct {
+	path    string
+	format  string
+	content []byte
+}
+
+// readVarsFile reads the variables file given by arg, a path or "-" for
+// standard input, optionally prefixed with a format as in "yaml:/dev/fd/63".
+func readVarsFile(arg string) (*varsFile, error) {
+	format, path := splitVarsFileArg(arg)
+
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(path)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if isJsonFile(path) {
-		result, err = unmarshalJsonFile(content)
-	} else if isYamlFile(path) {
-		result, err = unmarshalYamlFile(content)
-	} else {
-		err = fmt.Errorf("unsupported variables file type: %s", path)
+	if format == "" {
+		format = varsFileFormat(path)
+	}
+	return &varsFile{path: path, format: format, content: content}, nil
+}
+
+// parse parses the variables file, sniffing its format when unknown.
+func (f *varsFile) parse() (map[string]interface{}, error) {
+	if f.format == "" {
+		result, format, err := sniffVarsFile(f.path, f.content)
+		f.format = format
+		return result, err
+	}
+
+	result, err := varsParsers[f.format](f.content)
+	if err != nil {
+		return nil, newVarsDiagnostic(err, f)
 	}
+	return result, nil
+}
 
+func loadVarsFile(arg string) (map[string]interface{}, error) {
+	f, err := readVarsFile(arg)
 	if err != nil {
 		return nil, err
 	}
+	return f.parse()
+}
 
-	return result, err
+// sniffVarsFile parses a variables file of unknown format by trying JSON,
+// then YAML.
+func sniffVarsFile(path string, content []byte) (map[string]interface{}, string, error) {
+	result, jsonErr := unmarshalJsonFile(content)
+	if jsonErr == nil {
+		return result, "json", nil
+	}
+	result, yamlErr := unmarshalYamlFile(content)
+	if yamlErr == nil {
+		return result, "yaml", nil
+	}
+	return nil, "", &diagnostic{
+		kind:    diagnosticVars,
+		file:    path,
+		message: fmt.Sprintf("unknown format, tried json: %v; tried yaml: %v", jsonErr, yamlErr),
+	}
 }
 
 func unmarshalJsonFile(content []byte) (map[string]interface{}, error) {
@@ -128,8 +484,104 @@ func unmarshalYamlFile(content []byte) (map[string]interface{}, error) {
 	return vars, nil
 }
 
-func keyValToMap(key, val string) map[string]interface{} {
-	parts := strings.Split(key, ".")
+func unmarshalTomlFile(content []byte) (map[string]interface{}, error) {
+	var vars map[string]interface{}
+	err := toml.Unmarshal(content, &vars)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeToml(vars).(map[string]interface{}), nil
+}
+
+// normalizeToml converts arrays of tables, which the TOML decoder returns as
+// []map[string]interface{}, into []interface{} so that TOML variables have the
+// same shape as those read from JSON and YAML files.
+func normalizeToml(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = normalizeToml(item)
+		}
+		return v
+	case []map[string]interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = normalizeToml(item)
+		}
+		return result
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeToml(item)
+		}
+		return v
+	}
+	return v
+}
+
+var (
+	intValuePattern   = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)$`)
+	floatValuePattern = regexp.MustCompile(`^[-+]?(([0-9]+\.[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?|[0-9]+[eE][-+]?[0-9]+)$`)
+)
+
+func parseStringValue(val string) (interface{}, error) {
+	return val, nil
+}
+
+// parseTypedValue converts val into an integer, float, boolean or nil where
+// it looks like one, and leaves it a string otherwise. Numbers with leading
+// zeros, such as "0755", stay strings.
+func parseTypedValue(val string) (interface{}, error) {
+	switch val {
+	case "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if intValuePattern.MatchString(val) {
+		if i, err := strconv.Atoi(val); err == nil {
+			return i, nil
+		}
+	}
+	if floatValuePattern.MatchString(val) {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return f, nil
+		}
+	}
+	return val, nil
+}
+
+func parseJSONValue(val string) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(val), &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// readFileValue returns the content of the file at path, unmodified.
+func readFileValue(path string) (interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return string(content), nil
+}
+
+// readFileBase64Value returns the base64 encoded content of the file at path,
+// for binary files which cannot be used as text.
+func readFileBase64Value(path string) (interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.EncodeToString(content), nil
+}
+
+// splitKeyValToMap nests val in maps, one per part of key split on sep.
+func splitKeyValToMap(key, sep string, val interface{}) map[string]interface{} {
+	parts := strings.Split(key, sep)
 
 	// Reverse order
 	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
@@ -2,7 +2,9 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -30,7 +32,7 @@ func TestEnv(t *testing.T) {
 	}
 }
 
-func TestKeyValToMap(t *testing.T) {
+func TestSplitKeyValToMap(t *testing.T) {
 	tests := []struct {
 		key      string
 		value    string
@@ -44,7 +46,7 @@ func TestKeyValToMap(t *testing.T) {
 			},
 		},
 		{
-			"foo1.foo2",
+			"foo1__foo2",
 			"bar",
 			map[string]interface{}{
 				"foo1": map[string]interface{}{
@@ -53,7 +55,7 @@ func TestKeyValToMap(t *testing.T) {
 			},
 		},
 		{
-			"foo1.foo2.foo3",
+			"foo1__foo2__foo3",
 			"bar",
 			map[string]interface{}{
 				"foo1": map[string]interface{}{
@@ -65,9 +67,275 @@ func TestKeyValToMap(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		r := keyValToMap(test.key, test.value)
+		r := splitKeyValToMap(test.key, "__", test.value)
 		if !reflect.DeepEqual(r, test.expected) {
 			t.Errorf("broken behavior. Expected: %v. Got: %v", test.expected, r)
 		}
 	}
 }
+
+func TestUnmarshalTomlFile(t *testing.T) {
+	content := []byte(`
+name = "app"
+replicas = 3
+
+[db]
+host = "localhost"
+
+[[servers]]
+name = "a"
+
+[[servers]]
+name = "b"
+`)
+	expected := map[string]interface{}{
+		"name":     "app",
+		"replicas": int64(3),
+		"db": map[string]interface{}{
+			"host": "localhost",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"name": "a"},
+			map[string]interface{}{"name": "b"},
+		},
+	}
+	r, err := unmarshalTomlFile(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("broken behavior. Expected: %v. Got: %v", expected, r)
+	}
+}
+
+func TestSplitVarsFileArg(t *testing.T) {
+	tests := []struct {
+		in, format, path string
+	}{
+		{"vars.yaml", "", "vars.yaml"},
+		{"yaml:/dev/fd/63", "yaml", "/dev/fd/63"},
+		{"JSON:vars", "json", "vars"},
+		{"dotenv:prod", "dotenv", "prod"},
+		{"C:\\vars.yaml", "", "C:\\vars.yaml"},
+		{":vars", "", ":vars"},
+	}
+	for _, tt := range tests {
+		format, path := splitVarsFileArg(tt.in)
+		if format != tt.format || path != tt.path {
+			t.Errorf("broken behavior. Expected: %#v Got: %v %v", tt, format, path)
+		}
+	}
+}
+
+func TestLoadVarsFileSniffing(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name, content string
+		expected      map[string]interface{}
+		err           string
+	}{
+		{"vars.ajson", `{"a": "json"}`, map[string]interface{}{"a": "json"}, ""},
+		{"vars", "a: yaml", map[string]interface{}{"a": "yaml"}, ""},
+		{"bad", "- a", nil, "tried json: invalid character ' ' in numeric literal; tried yaml: yaml: unmarshal errors"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		r, err := loadVarsFile(path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("broken behavior for %s. Expected error: %v. Got: %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(r, tt.expected) {
+			t.Errorf("broken behavior for %s. Expected: %v. Got: %v %v", tt.name, tt.expected, r, err)
+		}
+	}
+}
+
+func TestLoadVarsFileExplicitFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vars.json")
+	if err := os.WriteFile(path, []byte("a: yaml"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := loadVarsFile("yaml:" + path)
+	expected := map[string]interface{}{"a": "yaml"}
+	if err != nil || !reflect.DeepEqual(r, expected) {
+		t.Errorf("broken behavior. Expected: %v. Got: %v %v", expected, r, err)
+	}
+
+	_, err = loadVarsFile(path)
+	if err == nil || !strings.Contains(err.Error(), "as json") {
+		t.Errorf("broken behavior. Expected error naming the json parser. Got: %v", err)
+	}
+}
+
+func TestParseTypedValue(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected interface{}
+	}{
+		{"3", 3},
+		{"-42", -42},
+		{"0", 0},
+		{"0755", "0755"},
+		{"1.5", 1.5},
+		{".5", 0.5},
+		{"1e3", 1000.0},
+		{"1.2.3", "1.2.3"},
+		{"true", true},
+		{"false", false},
+		{"null", nil},
+		{"True", "True"},
+		{"NaN", "NaN"},
+		{"Inf", "Inf"},
+		{"0x10", "0x10"},
+		{"", ""},
+		{"bar", "bar"},
+	}
+	for _, tt := range tests {
+		v, err := parseTypedValue(tt.in)
+		if err != nil || !reflect.DeepEqual(v, tt.expected) {
+			t.Errorf("broken behavior for %q. Expected: %#v Got: %#v %v", tt.in, tt.expected, v, err)
+		}
+	}
+}
+
+func TestParseJSONValue(t *testing.T) {
+	v, err := parseJSONValue(`{"a":[1,2]}`)
+	expected := map[string]interface{}{"a": []interface{}{1.0, 2.0}}
+	if err != nil || !reflect.DeepEqual(v, expected) {
+		t.Errorf("broken behavior. Expected: %#v Got: %#v %v", expected, v, err)
+	}
+	if _, err := parseJSONValue(`{"a"`); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestEnvVars(t *testing.T) {
+	os.Setenv("GUCCI_TEST_A", "a")
+	os.Setenv("GUCCI_TEST_", "empty")
+	defer os.Unsetenv("GUCCI_TEST_A")
+	defer os.Unsetenv("GUCCI_TEST_")
+
+	vars, _ := envVars(envOptions{mode: envModeRoot})
+	if vars["GUCCI_TEST_A"] != "a" {
+		t.Errorf("broken behavior in root mode. Got: %v", vars["GUCCI_TEST_A"])
+	}
+
+	vars, _ = envVars(envOptions{mode: envModeNamespaced, prefix: "GUCCI_TEST_"})
+	expected := map[string]interface{}{
+		"Env": map[string]interface{}{"A": "a"},
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("broken behavior in namespaced mode. Expected: %v Got: %v", expected, vars)
+	}
+
+	vars, _ = envVars(envOptions{mode: envModeNone})
+	if len(vars) != 0 {
+		t.Errorf("broken behavior in none mode. Got: %v", vars)
+	}
+}
+
+func TestEnvVarsSeparator(t *testing.T) {
+	os.Setenv("GUCCI_TEST__DB__HOST", "localhost")
+	os.Setenv("GUCCI_TEST__DB__PORT", "5432")
+	os.Setenv("GUCCI_TEST__FLAT", "flat")
+	os.Setenv("GUCCI_TEST__BAD____KEY", "bad")
+	defer os.Unsetenv("GUCCI_TEST__DB__HOST")
+	defer os.Unsetenv("GUCCI_TEST__DB__PORT")
+	defer os.Unsetenv("GUCCI_TEST__FLAT")
+	defer os.Unsetenv("GUCCI_TEST__BAD____KEY")
+
+	vars, _ := envVars(envOptions{mode: envModeRoot, prefix: "GUCCI_TEST", separator: "__"})
+	expected := map[string]interface{}{
+		"DB": map[string]interface{}{
+			"HOST": "localhost",
+			"PORT": "5432",
+		},
+		"FLAT":       "flat",
+		"BAD____KEY": "bad",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("broken behavior. Expected: %v Got: %v", expected, vars)
+	}
+}
+
+func TestEnvVarsFilesWithPrefix(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GUCCI_TEST_PW_FILE", secret)
+	os.Setenv("GUCCI_OTHER_FILE", filepath.Join(t.TempDir(), "missing"))
+	os.Setenv("GUCCI_OTHER", "other")
+	defer os.Unsetenv("GUCCI_TEST_PW_FILE")
+	defer os.Unsetenv("GUCCI_OTHER_FILE")
+	defer os.Unsetenv("GUCCI_OTHER")
+
+	vars, err := envVars(envOptions{mode: envModeRoot, prefix: "GUCCI_TEST_", resolveFiles: true, filesAllow: []string{"PW"}})
+	expected := map[string]interface{}{"PW_FILE": secret, "PW": "s3cret"}
+	if err != nil || !reflect.DeepEqual(vars, expected) {
+		t.Errorf("broken behavior. Expected: %v Got: %v %v", expected, vars, err)
+	}
+}
+
+func TestResolveFileEnv(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		environ     map[string]interface{}
+		allow, deny []string
+		expected    map[string]interface{}
+		err         string
+	}{
+		{
+			map[string]interface{}{"DB_PASSWORD_FILE": secret},
+			nil, nil,
+			map[string]interface{}{"DB_PASSWORD_FILE": secret, "DB_PASSWORD": "s3cret"},
+			"",
+		},
+		{
+			map[string]interface{}{"A_FILE": secret, "B_FILE": missing},
+			[]string{"A"}, nil,
+			map[string]interface{}{"A_FILE": secret, "A": "s3cret", "B_FILE": missing},
+			"",
+		},
+		{
+			map[string]interface{}{"A_FILE": secret, "B_FILE": missing},
+			nil, []string{"B_FILE"},
+			map[string]interface{}{"A_FILE": secret, "A": "s3cret", "B_FILE": missing},
+			"",
+		},
+		{
+			map[string]interface{}{"B_FILE": missing},
+			nil, nil, nil,
+			"Error reading B from B_FILE",
+		},
+		{
+			map[string]interface{}{"A": "a", "A_FILE": secret},
+			nil, nil, nil,
+			"Both A and A_FILE are set",
+		},
+	}
+	for _, tt := range tests {
+		err := resolveFileEnv(tt.environ, tt.allow, tt.deny)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("broken behavior. Expected error: %v Got: %v", tt.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(tt.environ, tt.expected) {
+			t.Errorf("broken behavior. Expected: %v Got: %v %v", tt.expected, tt.environ, err)
+		}
+	}
+}
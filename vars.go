@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// varsCommand prints the variables that would be passed to templates, or
+// with --explain, the sources setting one of them.
+func varsCommand() cli.Command {
+	return cli.Command{
+		Name:      "vars",
+		Usage:     "Print the merged variables passed to templates",
+		ArgsUsage: " ",
+		Flags: append(variableFlags(),
+			cli.StringFlag{
+				Name:  flagFormat,
+				Usage: "The output `FORMAT`, yaml or json",
+				Value: "yaml",
+			},
+			cli.StringFlag{
+				Name:  flagExplain,
+				Usage: "Print every source setting `KEY`, from lowest to highest precedence, instead of the variables",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			err := checkStdinUsage(false, optionStringSlice(c, flagVarsFile))
+			if err != nil {
+				return exitError(c, err, diagnosticUsage)
+			}
+			if key := c.String(flagExplain); key != "" {
+				sources, err := loadVariableSources(c)
+				if err != nil {
+					return exitError(c, err, diagnosticVars)
+				}
+				err = explainVariable(os.Stdout, sources, key)
+				if err != nil {
+					return exitError(c, err, diagnosticVars)
+				}
+				return nil
+			}
+			vars, err := loadVariables(c)
+			if err != nil {
+				return exitError(c, err, diagnosticVars)
+			}
+			err = printVariables(os.Stdout, vars, c.String(flagFormat))
+			if err != nil {
+				return exitError(c, err, diagnosticOutput)
+			}
+			return nil
+		},
+	}
+}
+
+func printVariables(out io.Writer, vars map[string]interface{}, format string) error {
+	if format != "yaml" && format != "json" {
+		return withKind(diagnosticUsage, fmt.Errorf("Invalid format %q: must be yaml or json", format))
+	}
+
+	var data []byte
+	var err error
+	if format == "json" {
+		data, err = json.MarshalIndent(convertToJSONCompatible(vars), "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = yaml.Marshal(vars)
+	}
+	if err != nil {
+		return fmt.Errorf("Error printing variables: %v", err)
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+// explainVariable prints each source setting or deleting key along with the
+// resulting value, followed by the final value.
+//
+// A source sets the key when applying it on its own produces the key, so
+// sources which merely keep a value set by a lower precedence source are not
+// listed.
+func explainVariable(out io.Writer, sources []varSource, key string) error {
+	path, err := parseKeyPath(key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Sources setting %s, from lowest to highest precedence:\n", key)
+	vars := make(map[string]interface{})
+	found := false
+	for _, source := range sources {
+		_, existed := getKeyPath(vars, path)
+		err := source.apply(vars)
+		if err != nil {
+			return err
+		}
+		val, exists := getKeyPath(vars, path)
+
+		own := make(map[string]interface{})
+		err = source.apply(own)
+		if err != nil {
+			return err
+		}
+		_, set := getKeyPath(own, path)
+
+		switch {
+		case set && exists:
+			found = true
+			fmt.Fprintf(out, "  %s: %s\n", sourceLocation(source, path), explainValue(val))
+		case existed && !exists:
+			found = true
+			fmt.Fprintf(out, "  %s: deleted\n", sourceLocation(source, path))
+		}
+	}
+	if !found {
+		fmt.Fprintln(out, "  none")
+	}
+
+	if val, ok := getKeyPath(vars, path); ok {
+		fmt.Fprintf(out, "Value: %s\n", explainValue(val))
+	} else {
+		fmt.Fprintln(out, "Value: not set")
+	}
+	return nil
+}
+
+// sourceLocation names a source, with the line setting path where known.
+func sourceLocation(source varSource, path []keyPathSegment) string {
+	if source.line != nil {
+		if line := source.line(path); line > 0 {
+			return fmt.Sprintf("%s:%d", source.name, line)
+		}
+	}
+	return source.name
+}
+
+func explainValue(v interface{}) string {
+	data, err := json.Marshal(convertToJSONCompatible(v))
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
+
+// keyLine returns the line of the variables file setting path, or 0 when it
+// cannot be found. It assumes the file has been parsed, so that its format is
+// known.
+func (f *varsFile) keyLine(path []keyPathSegment) int {
+	switch f.format {
+	case "json", "yaml", "yml":
+		return yamlKeyLine(f.content, path)
+	case "env", "dotenv":
+		if len(path) == 1 && !path[0].isIndex {
+			return dotenvKeyLines(f.content)[path[0].key]
+		}
+	}
+	return 0
+}
+
+// yamlKeyLine returns the line of the key or list element at path in a YAML
+// or JSON document.
+func yamlKeyLine(content []byte, path []keyPathSegment) int {
+	var doc yamlv3.Node
+	if yamlv3.Unmarshal(content, &doc) != nil || len(doc.Content) == 0 {
+		return 0
+	}
+
+	node, line := doc.Content[0], 0
+	for _, seg := range path {
+		if node.Kind == yamlv3.AliasNode {
+			node = node.Alias
+		}
+		switch {
+		case seg.isIndex && node.Kind == yamlv3.SequenceNode:
+			if seg.index < 0 || seg.index >= len(node.Content) {
+				return 0
+			}
+			node = node.Content[seg.index]
+			line = node.Line
+		case !seg.isIndex && node.Kind == yamlv3.MappingNode:
+			var value *yamlv3.Node
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == seg.key {
+					line, value = node.Content[i].Line, node.Content[i+1]
+				}
+			}
+			if value == nil {
+				return 0
+			}
+			node = value
+		default:
+			return 0
+		}
+	}
+	return line
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestYamlKeyLine(t *testing.T) {
+	yamlContent := []byte(`db:
+  host: localhost
+  port: 5432
+servers:
+  - name: a
+  - name: b
+`)
+	jsonContent := []byte(`{
+  "db": {
+    "host": "localhost"
+  }
+}`)
+	tests := []struct {
+		content  []byte
+		key      string
+		expected int
+	}{
+		{yamlContent, "db", 1},
+		{yamlContent, "db.port", 3},
+		{yamlContent, "servers[1]", 6},
+		{yamlContent, "servers[1].name", 6},
+		{yamlContent, "servers[2]", 0},
+		{yamlContent, "db.user", 0},
+		{jsonContent, "db.host", 3},
+	}
+	for _, tt := range tests {
+		path, err := parseKeyPath(tt.key)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", tt.key, err)
+		}
+		if line := yamlKeyLine(tt.content, path); line != tt.expected {
+			t.Errorf("yamlKeyLine(%q) broken behavior. Expected: %d Got: %d", tt.key, tt.expected, line)
+		}
+	}
+}
+
+func TestExplainVariable(t *testing.T) {
+	setTo := func(name string, val interface{}, line int) varSource {
+		return varSource{
+			name: name,
+			apply: func(vars map[string]interface{}) error {
+				return mergeVars(vars, map[string]interface{}{"a": val}, defaultMergeStrategy.withDirectives())
+			},
+			line: func(path []keyPathSegment) int { return line },
+		}
+	}
+	unrelated := varSource{
+		name: "unrelated",
+		apply: func(vars map[string]interface{}) error {
+			vars["other"] = 1
+			return nil
+		},
+	}
+	sources := []varSource{
+		setTo("first", "1", 4),
+		unrelated,
+		setTo("second", deleteMarker, 2),
+		setTo("third", map[string]interface{}{"b": true}, 0),
+	}
+
+	var b bytes.Buffer
+	if err := explainVariable(&b, sources, "a"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `Sources setting a, from lowest to highest precedence:
+  first:4: "1"
+  second:2: deleted
+  third: {"b":true}
+Value: {"b":true}
+`
+	if b.String() != expected {
+		t.Errorf("explainVariable broken behavior. Expected:\n%s Got:\n%s", expected, b.String())
+	}
+}